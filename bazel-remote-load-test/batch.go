@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"fmt"
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/dustin/go-humanize"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+)
+import "flag"
+
+var instanceName = flag.String("instance_name", "instance-name", "Instance name of ContentAddressableStorage and ActionCache requests")
+var casIterations = flag.Int("cas_iterations", 0, "Number of times to upload and read back each file smaller than -batch_max_size using FindMissingBlobs, BatchUpdateBlobs and BatchReadBlobs")
+var acIterations = flag.Int("ac_iterations", 0, "Number of times to update and get an action result for each batch of files, with outputs referencing them")
+var batchMaxSize = flag.Int64("batch_max_size", 4<<20-64<<10, "Maximum total size of blobs in a batch request, below gRPC message size limit")
+
+// Number of batch read blobs which did not match expected size or hash
+var corruptedBatchReads int64
+
+// Random bytes appended to files uploaded by casBatch
+const batchExtraBytes = 16
+
+// Maximum number of blobs in a batch, FindMissingBlobs requests have two digests for each of them and action results
+// an output file with a name
+const batchMaxBlobs = 4096
+
+// batchBlobCost returns size of the blob of a file in batch requests, including its digest and framing.
+func batchBlobCost(f *FileData) int64 {
+	return f.Size + batchExtraBytes + int64(2*newHash().Size()) + 32
+}
+
+// getBatches groups files into batches of up to batchMaxBlobs, with total size including overhead of every blob up to
+// -batch_max_size. Larger files are skipped.
+func getBatches(files []*FileData) [][]*FileData {
+	var batches [][]*FileData
+	var batch []*FileData
+	var size int64
+	for _, f := range files {
+		cost := batchBlobCost(f)
+		if cost > *batchMaxSize {
+			continue
+		}
+		if size+cost > *batchMaxSize || len(batch) == batchMaxBlobs {
+			batches = append(batches, batch)
+			batch, size = nil, 0
+		}
+		batch = append(batch, f)
+		size += cost
+	}
+	if len(batch) > 0 {
+		batches = append(batches, batch)
+	}
+	return batches
+}
+
+func batchSize(batch []*FileData) int64 {
+	var size int64
+	for _, f := range batch {
+		size += f.Size
+	}
+	return size
+}
+
+func digestKey(d *remoteexecution.Digest) string {
+	return fmt.Sprintf("%s/%d", d.GetHash(), d.GetSizeBytes())
+}
+
+// batchBlobs reads files of the batch with the same random bytes appended, and returns digests of the blobs, of the
+// base files, and blobs by digestKey.
+func batchBlobs(batch []*FileData) (digests, baseDigests []*remoteexecution.Digest, blobs map[string][]byte, err error) {
+	extraBytes := make([]byte, batchExtraBytes)
+	_, err = rand.Read(extraBytes)
+	noError(err)
+
+	blobs = make(map[string][]byte)
+	for _, f := range batch {
+		data, err := ioutil.ReadFile(f.Path)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		data = append(data, extraBytes...)
+		d := &remoteexecution.Digest{Hash: extendHash(f.HashState, extraBytes), SizeBytes: int64(len(data))}
+		digests = append(digests, d)
+		blobs[digestKey(d)] = data
+		baseDigests = append(baseDigests, &remoteexecution.Digest{Hash: f.Hash, SizeBytes: f.Size})
+	}
+	return digests, baseDigests, blobs, nil
+}
+
+// casBatch uploads the batch of files with random bytes appended the way Bazel uploads small outputs: it checks
+// which blobs are missing with FindMissingBlobs, together with base files which are expected to exist, uploads the
+// missing ones with BatchUpdateBlobs and reads them back with BatchReadBlobs.
+func casBatch(client *Client, batch []*FileData) error {
+	digests, baseDigests, blobs, err := batchBlobs(batch)
+	if err != nil {
+		return err
+	}
+	size := batchSize(batch)
+
+	start := time.Now()
+	missing, err := client.CAS.FindMissingBlobs(context.Background(), &remoteexecution.FindMissingBlobsRequest{
+		InstanceName:   *instanceName,
+		BlobDigests:    append(baseDigests, digests...),
+		DigestFunction: digestFunctionValue(),
+	})
+	if err != nil {
+		return err
+	}
+	recordLatency("FIND_MISSING", size, Latency{Total: time.Now().Sub(start)})
+	if len(missing.MissingBlobDigests) != len(digests) {
+		return fmt.Errorf("FindMissingBlobs returned %d missing blobs, expected %d", len(missing.MissingBlobDigests), len(digests))
+	}
+
+	update := &remoteexecution.BatchUpdateBlobsRequest{InstanceName: *instanceName, DigestFunction: digestFunctionValue()}
+	for _, d := range missing.MissingBlobDigests {
+		data, ok := blobs[digestKey(d)]
+		if !ok {
+			return fmt.Errorf("FindMissingBlobs returned unexpected missing blob: %s", digestKey(d))
+		}
+		update.Requests = append(update.Requests, &remoteexecution.BatchUpdateBlobsRequest_Request{Digest: d, Data: data})
+	}
+	start = time.Now()
+	updated, err := client.CAS.BatchUpdateBlobs(context.Background(), update)
+	if err != nil {
+		return err
+	}
+	recordLatency("BATCH_UPDATE", size, Latency{Total: time.Now().Sub(start)})
+	for _, r := range updated.Responses {
+		if err := status.FromProto(r.Status).Err(); err != nil {
+			return fmt.Errorf("BatchUpdateBlobs failed for %s: %s", digestKey(r.Digest), err)
+		}
+	}
+
+	start = time.Now()
+	read, err := client.CAS.BatchReadBlobs(context.Background(), &remoteexecution.BatchReadBlobsRequest{
+		InstanceName:   *instanceName,
+		Digests:        digests,
+		DigestFunction: digestFunctionValue(),
+	})
+	if err != nil {
+		return err
+	}
+	recordLatency("BATCH_READ", size, Latency{Total: time.Now().Sub(start)})
+	for _, r := range read.Responses {
+		if err := status.FromProto(r.Status).Err(); err != nil {
+			return fmt.Errorf("BatchReadBlobs failed for %s: %s", digestKey(r.Digest), err)
+		}
+		if !bytes.Equal(r.Data, blobs[digestKey(r.Digest)]) {
+			atomic.AddInt64(&corruptedBatchReads, 1)
+			recordError("BATCH_READ")
+			log.Printf("CAS       %s", &CorruptionError{digestKey(r.Digest), "batch read data does not match uploaded data"})
+		}
+	}
+	return nil
+}
+
+// batchActionResult returns an action result with files of the batch as outputs.
+func batchActionResult(batch []*FileData) *remoteexecution.ActionResult {
+	ar := &remoteexecution.ActionResult{ExitCode: 0}
+	for _, f := range batch {
+		ar.OutputFiles = append(ar.OutputFiles, &remoteexecution.OutputFile{
+			Path:   filepath.Base(f.Path),
+			Digest: &remoteexecution.Digest{Hash: f.Hash, SizeBytes: f.Size},
+		})
+	}
+	return ar
+}
+
+// acAction updates an action result with output files of the batch, gets it back, and gets result of an action which
+// does not exist.
+func acAction(client *Client, batch []*FileData) error {
+	action := make([]byte, 256)
+	_, err := rand.Read(action)
+	noError(err)
+	h := newHash()
+	h.Write(action)
+	actionDigest := &remoteexecution.Digest{Hash: hex.EncodeToString(h.Sum(nil)), SizeBytes: int64(len(action))}
+
+	ar := batchActionResult(batch)
+	size := int64(proto.Size(ar))
+
+	start := time.Now()
+	if err := client.UpdateActionResult(actionDigest, ar); err != nil {
+		return err
+	}
+	recordLatency("AC_UPDATE", size, Latency{Total: time.Now().Sub(start)})
+
+	start = time.Now()
+	got, err := client.GetActionResult(actionDigest)
+	if err != nil {
+		return err
+	}
+	recordLatency("AC_GET", size, Latency{Total: time.Now().Sub(start)})
+	if !proto.Equal(got, ar) {
+		return fmt.Errorf("GetActionResult returned different action result for %s", digestKey(actionDigest))
+	}
+
+	// Same action with different input, which was not executed yet
+	action[0]++
+	h.Reset()
+	h.Write(action)
+	start = time.Now()
+	_, err = client.GetActionResult(&remoteexecution.Digest{Hash: hex.EncodeToString(h.Sum(nil)), SizeBytes: int64(len(action))})
+	recordLatency("AC_MISS", size, Latency{Total: time.Now().Sub(start)})
+	if status.Code(err) != codes.NotFound {
+		return fmt.Errorf("expected not found error for missing action result, got: %v", err)
+	}
+	return nil
+}
+
+func casBenchmark(files []*FileData) {
+	batches := getBatches(files)
+	if len(batches) == 0 {
+		log.Printf("CAS       No files smaller than %s", humanize.IBytes(uint64(*batchMaxSize)))
+		return
+	}
+	start := time.Now()
+	var count, size int64
+	runClosedLoop("CAS", benchmarkRequests(*casIterations, len(batches)), func(client *Client, i int) {
+		batch := batches[i%len(batches)]
+		noError(casBatch(client, batch))
+		atomic.AddInt64(&count, 1)
+		atomic.AddInt64(&size, batchSize(batch))
+	})
+	elapsed := time.Now().Sub(start)
+	log.Printf("CAS       finished %d batches in %s, size: %s  avg throughput: %s/s", count, elapsed.Round(time.Millisecond),
+		humanize.Bytes(uint64(size)), humanize.Bytes(uint64(float64(size)/elapsed.Seconds())))
+	log.Printf("CAS       corrupted: %d", atomic.LoadInt64(&corruptedBatchReads))
+}
+
+func acBenchmark(files []*FileData) {
+	batches := getBatches(files)
+	if len(batches) == 0 {
+		log.Printf("AC        No files smaller than %s", humanize.IBytes(uint64(*batchMaxSize)))
+		return
+	}
+	start := time.Now()
+	var count int64
+	runClosedLoop("AC", benchmarkRequests(*acIterations, len(batches)), func(client *Client, i int) {
+		noError(acAction(client, batches[i%len(batches)]))
+		atomic.AddInt64(&count, 1)
+	})
+	elapsed := time.Now().Sub(start)
+	log.Printf("AC        finished %d actions in %s, %.1f actions/s", count, elapsed.Round(time.Millisecond),
+		float64(count)/elapsed.Seconds())
+}
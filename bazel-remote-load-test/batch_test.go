@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"google.golang.org/protobuf/proto"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Default gRPC limit of received messages
+const grpcDefaultMaxMsgSize = 4 << 20
+
+// tinyFiles writes n files of given size with long names, the most overhead per byte in batch requests.
+func tinyFiles(t *testing.T, n int, size int) []*FileData {
+	dir := t.TempDir()
+	var files []*FileData
+	for i := 0; i < n; i++ {
+		data, _ := testBlob(size)
+		data[0] = byte(i)
+		path := filepath.Join(dir, fmt.Sprintf("%s-%d", strings.Repeat("f", 200), i))
+		if err := ioutil.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		state, _, hash := getFileHash(path)
+		files = append(files, &FileData{Path: path, Size: int64(size), Hash: hash, HashState: state})
+	}
+	return files
+}
+
+func TestBatchesOfTinyFiles(t *testing.T) {
+	// Longest hashes
+	setString(t, digestFunction, "sha512")
+	files := tinyFiles(t, 20000, 100)
+	batches := getBatches(files)
+	n := 0
+	for _, batch := range batches {
+		n += len(batch)
+		digests, baseDigests, blobs, err := batchBlobs(batch)
+		if err != nil {
+			t.Fatal(err)
+		}
+		update := &remoteexecution.BatchUpdateBlobsRequest{InstanceName: *instanceName, DigestFunction: digestFunctionValue()}
+		read := &remoteexecution.BatchReadBlobsResponse{}
+		for _, d := range digests {
+			data := blobs[digestKey(d)]
+			update.Requests = append(update.Requests, &remoteexecution.BatchUpdateBlobsRequest_Request{Digest: d, Data: data})
+			read.Responses = append(read.Responses, &remoteexecution.BatchReadBlobsResponse_Response{Digest: d, Data: data})
+		}
+		for name, m := range map[string]proto.Message{
+			"FindMissingBlobs": &remoteexecution.FindMissingBlobsRequest{
+				InstanceName:   *instanceName,
+				BlobDigests:    append(baseDigests, digests...),
+				DigestFunction: digestFunctionValue(),
+			},
+			"BatchUpdateBlobs": update,
+			"BatchReadBlobs":   read,
+			"UpdateActionResult": &remoteexecution.UpdateActionResultRequest{
+				InstanceName:   *instanceName,
+				ActionDigest:   digests[0],
+				ActionResult:   batchActionResult(batch),
+				DigestFunction: digestFunctionValue(),
+			},
+		} {
+			if size := proto.Size(m); size > grpcDefaultMaxMsgSize {
+				t.Fatalf("%s of %d files: %d bytes over gRPC limit", name, len(batch), size)
+			}
+		}
+	}
+	if n != len(files) {
+		t.Fatalf("batches have %d files, expected %d", n, len(files))
+	}
+
+	// Full batches against the server, base files are expected to exist
+	_, client := serveTestServer(t, "uncompressed")
+	for _, batch := range batches[:2] {
+		for _, f := range batch {
+			if err := uploadFile(client, f.Path, f.Size, f.Hash); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := casBatch(client, batch); err != nil {
+			t.Fatalf("CAS batch of %d files: %s", len(batch), err)
+		}
+		if err := acAction(client, batch); err != nil {
+			t.Fatalf("AC action of %d files: %s", len(batch), err)
+		}
+	}
+}
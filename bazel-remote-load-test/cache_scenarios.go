@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/hex"
+	"github.com/dustin/go-humanize"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"io"
+	"log"
+	"math/rand"
+	"sync/atomic"
+	"time"
+)
+import "flag"
+
+var missRate = flag.Float64("miss_rate", 0, "Probability of a download requesting a random digest which does not exist, reported as MISS")
+var coldCache = flag.Bool("cold_cache", false, "Do not upload base files, so downloads of files not yet in the cache are reported as NOT_FOUND")
+var evictFill = flag.String("evict_fill", "", "Eviction scenario: upload this many bytes of generated blobs after base files, e.g. more than the server capacity, and read everything back oldest first")
+var evictBlobSize = flag.String("evict_blob_size", "1MiB", "Size of blobs uploaded by -evict_fill")
+
+// Numbers of downloads which found the blob, of missing digests, and of blobs which were expected but not found
+var downloadHits, downloadMisses, downloadNotFound int64
+
+// Number of groups of the eviction scenario report, by upload order from the oldest blobs to the newest
+const evictGroups = 10
+
+func checkCacheScenarioFlags() {
+	if *missRate < 0 || *missRate > 1 {
+		log.Fatalf("Invalid miss rate: %f", *missRate)
+	}
+	if (*coldCache || *evictFill != "") && (*workloadProfile != "" || *casIterations > 0) {
+		log.Fatal("-cold_cache and -evict_fill can not be used with -workload or -cas_iterations, which need base files")
+	}
+	if *addr == embeddedAddr && *embeddedMaxSize != "" && (*workloadProfile != "" || *casIterations > 0) {
+		log.Fatal("-embedded_max_size can not be used with -workload or -cas_iterations, which need base files not to be evicted")
+	}
+	if *evictFill != "" {
+		if _, err := humanize.ParseBytes(*evictFill); err != nil {
+			log.Fatalf("Invalid eviction fill size: %s", *evictFill)
+		}
+	}
+	if s, err := humanize.ParseBytes(*evictBlobSize); err != nil || s == 0 {
+		log.Fatalf("Invalid eviction blob size: %s", *evictBlobSize)
+	}
+}
+
+// randomHash returns a random hash of -digest_function, which is not expected to exist.
+func randomHash(r io.Reader) string {
+	hash := make([]byte, newHash().Size())
+	_, err := r.Read(hash)
+	noError(err)
+	return hex.EncodeToString(hash)
+}
+
+// downloadMissing downloads a random digest of given size read from r, expecting it not to be found.
+func downloadMissing(client *Client, r io.Reader, size int64, queue time.Duration) {
+	l, err := client.Download(size, randomHash(r))
+	l.Queue = queue
+	recordLatency("MISS", size, l)
+	if status.Code(err) != codes.NotFound {
+		recordError("MISS")
+		log.Printf("MISS      expected not found error for missing blob, got: %v", err)
+		return
+	}
+	atomic.AddInt64(&downloadMisses, 1)
+}
+
+func logDownloadHits() {
+	notFound := atomic.LoadInt64(&downloadNotFound)
+	if *missRate == 0 && !*coldCache && notFound == 0 {
+		return
+	}
+	log.Printf("DOWNLOAD  hits: %d, misses: %d, not found: %d", atomic.LoadInt64(&downloadHits),
+		atomic.LoadInt64(&downloadMisses), notFound)
+}
+
+// evictionBenchmark uploads -evict_fill bytes of generated blobs, and then reads back base files and the generated
+// blobs in upload order, reporting how many of them were found by their age. Reads of found blobs are reported as
+// EVICT_READ, and of evicted blobs as NOT_FOUND.
+func evictionBenchmark(files []*FileData) {
+	fill, _ := humanize.ParseBytes(*evictFill)
+	blobSize, _ := humanize.ParseBytes(*evictBlobSize)
+	n := int((fill + blobSize - 1) / blobSize)
+
+	// Oldest first
+	blobs := make([]*workloadBlob, 0, len(files)+n)
+	if !*coldCache {
+		for _, f := range files {
+			blobs = append(blobs, &workloadBlob{path: f.Path, size: f.Size, hash: f.Hash, hashState: f.HashState})
+		}
+	}
+	base := len(blobs)
+	seed := rand.Int63()
+	for i := 0; i < n; i++ {
+		blobs = append(blobs, newGeneratedBlob(seed+int64(i), int64(blobSize)))
+	}
+
+	start := time.Now()
+	runClosedLoop("FILL", n, func(client *Client, i int) {
+		b := blobs[base+i]
+		for {
+			l, err := client.Upload(b.open, b.size, b.hash)
+			if err != errUploadCancelled {
+				noError(err)
+				recordLatency("FILL", b.size, l)
+				return
+			}
+		}
+	})
+	elapsed := time.Now().Sub(start)
+	log.Printf("EVICT     uploaded %d blobs, size: %s in %s  avg throughput: %s/s", n, humanize.IBytes(uint64(n)*blobSize),
+		elapsed.Round(time.Millisecond), humanize.Bytes(uint64(float64(uint64(n)*blobSize)/elapsed.Seconds())))
+
+	found := make([]int32, len(blobs))
+	start = time.Now()
+	runClosedLoop("EVICT_READ", len(blobs), func(client *Client, i int) {
+		b := blobs[i]
+		l, err := client.Download(b.size, b.hash)
+		if status.Code(err) == codes.NotFound {
+			recordLatency("NOT_FOUND", b.size, l)
+			return
+		}
+		if isCorruption(err) {
+			recordError("EVICT_READ")
+			log.Printf("EVICT     %s", err)
+		} else {
+			noError(err)
+		}
+		recordLatency("EVICT_READ", b.size, l)
+		atomic.StoreInt32(&found[i], 1)
+	})
+	log.Printf("EVICT     read %d blobs oldest first in %s", len(blobs), time.Now().Sub(start).Round(time.Millisecond))
+
+	for g := 0; g < evictGroups; g++ {
+		from, to := g*len(blobs)/evictGroups, (g+1)*len(blobs)/evictGroups
+		hits := 0
+		for _, f := range found[from:to] {
+			hits += int(f)
+		}
+		log.Printf("EVICT     uploaded %3d%%-%3d%%  blobs: %6d  hits: %6d  not found: %6d", 100*g/evictGroups, 100*(g+1)/evictGroups,
+			to-from, hits, to-from-hits)
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"log"
+	"runtime"
+	"syscall"
+	"time"
+)
+
+// Fraction of cores used by the client above which results may be limited by the client instead of the server
+const clientCpuSaturation = 0.9
+
+// clientCpu is CPU time used by this process up to a point in time.
+type clientCpu struct {
+	time time.Time
+	user time.Duration
+	sys  time.Duration
+}
+
+func getClientCpu() clientCpu {
+	var rusage syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &rusage); err != nil {
+		panic(err)
+	}
+	return clientCpu{
+		time: time.Now(),
+		user: time.Duration(rusage.Utime.Sec*1000000000 + rusage.Utime.Usec*1000),
+		sys:  time.Duration(rusage.Stime.Sec*1000000000 + rusage.Stime.Usec*1000),
+	}
+}
+
+// logClientCpu logs user and system CPU time used by the client since start, and warns if it used nearly all cores.
+// It includes the embedded server, which runs in the same process.
+func logClientCpu(phase string, start clientCpu) {
+	end := getClientCpu()
+	user, sys := end.user-start.user, end.sys-start.sys
+	elapsed := end.time.Sub(start.time)
+	cores := (user + sys).Seconds() / elapsed.Seconds()
+	embedded := ""
+	if embeddedServerStarted {
+		embedded = ", including embedded server"
+	}
+	log.Printf("CLIENT    %s cpu: user: %s  sys: %s  in %s (%.2f of %d cores%s)", phase, user.Round(time.Millisecond),
+		sys.Round(time.Millisecond), elapsed.Round(time.Millisecond), cores, runtime.NumCPU(), embedded)
+	if cores >= clientCpuSaturation*float64(runtime.NumCPU()) {
+		log.Printf("CLIENT    WARNING: %s used %.0f%% of %d cores, results may be limited by the client", phase,
+			100*cores/float64(runtime.NumCPU()), runtime.NumCPU())
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding"
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/zeebo/blake3"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"hash"
+	"log"
+	"strings"
+)
+import "flag"
+
+var digestFunction = flag.String("digest_function", "sha256", "Digest function of blobs: sha256, sha1, sha384, sha512 or blake3")
+
+// digestFunctions creates hashes by lowercase REAPI digest function name.
+var digestFunctions = map[string]func() hash.Hash{
+	"sha256": sha256.New,
+	"sha1":   sha1.New,
+	"sha384": sha512.New384,
+	"sha512": sha512.New,
+	"blake3": func() hash.Hash { return blake3.New() },
+}
+
+// Digest functions whose name is omitted from resource names, they are identified by hash length
+var legacyDigestFunctions = map[string]bool{"sha256": true, "sha1": true, "sha384": true, "sha512": true}
+
+// BLAKE3 digest function, which is not in this version of remote-apis
+const digestFunctionBlake3 remoteexecution.DigestFunction_Value = 9
+
+// Values of digest_function fields of CAS and AC requests by name
+var digestFunctionValues = map[string]remoteexecution.DigestFunction_Value{
+	"sha256": remoteexecution.DigestFunction_SHA256,
+	"sha1":   remoteexecution.DigestFunction_SHA1,
+	"sha384": remoteexecution.DigestFunction_SHA384,
+	"sha512": remoteexecution.DigestFunction_SHA512,
+	"blake3": digestFunctionBlake3,
+}
+
+func checkDigestFunction() {
+	*digestFunction = strings.ToLower(*digestFunction)
+	if _, ok := digestFunctions[*digestFunction]; !ok {
+		log.Fatalf("Unknown digest function: %s", *digestFunction)
+	}
+	// Paths of the HTTP cache protocol have no digest function, so the server would take BLAKE3 for SHA-256
+	if !legacyDigestFunctions[*digestFunction] && *transport == "http" {
+		log.Fatalf("Digest function %s needs grpc transport", *digestFunction)
+	}
+}
+
+// digestFunctionValue returns digest function of CAS and AC requests.
+func digestFunctionValue() remoteexecution.DigestFunction_Value {
+	return digestFunctionValues[*digestFunction]
+}
+
+// checkRequestDigestFunction returns an error if digest function of a CAS or AC request is not -digest_function,
+// it may be unknown for functions identified by hash length.
+func checkRequestDigestFunction(v remoteexecution.DigestFunction_Value) error {
+	if v == remoteexecution.DigestFunction_UNKNOWN && legacyDigestFunctions[*digestFunction] || v == digestFunctionValue() {
+		return nil
+	}
+	return status.Errorf(codes.InvalidArgument, "digest function of request is not %s: %s", *digestFunction, v)
+}
+
+// newHash returns a hash of -digest_function.
+func newHash() hash.Hash {
+	return digestFunctions[*digestFunction]()
+}
+
+// hashPath returns the digest path segments of a resource name: the hash, preceded by the digest function name
+// unless it is identified by hash length.
+func hashPath(hash string) string {
+	if legacyDigestFunctions[*digestFunction] {
+		return hash
+	}
+	return *digestFunction + "/" + hash
+}
+
+// resourceName replaces {hash} and {sha256} placeholders of the template with the digest path of the hash.
+func resourceName(tpl string, hash string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(tpl, "{hash}", hashPath(hash)), "{sha256}", hashPath(hash))
+}
+
+// hashState is saved state of a hash, from which hashing can be continued any number of times. SHA hashes are
+// marshalled, BLAKE3 hashes can only be cloned.
+type hashState struct {
+	marshalled []byte
+	blake3     *blake3.Hasher
+}
+
+func saveHashState(h hash.Hash) hashState {
+	if b, ok := h.(*blake3.Hasher); ok {
+		return hashState{blake3: b.Clone()}
+	}
+	m, err := h.(encoding.BinaryMarshaler).MarshalBinary()
+	noError(err)
+	return hashState{marshalled: m}
+}
+
+// resume returns a new hash continuing from the saved state.
+func (s hashState) resume() hash.Hash {
+	if s.blake3 != nil {
+		return s.blake3.Clone()
+	}
+	h := newHash()
+	noError(h.(encoding.BinaryUnmarshaler).UnmarshalBinary(s.marshalled))
+	return h
+}
@@ -1,44 +1,144 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"google.golang.org/genproto/googleapis/bytestream"
+	"hash"
 	"io"
 	"strconv"
 	"strings"
+	"time"
 )
 import "flag"
 
-var downloadTpl = flag.String("download_template", "instance-name/blobs/{sha256}/{size}", "Resource name, download template")
+var downloadTpl = flag.String("download_template", "instance-name/blobs/{hash}/{size}", "Resource name, download template")
+var compressedDownloadTpl = flag.String("compressed_download_template", "instance-name/compressed-blobs/zstd/{hash}/{size}", "Resource name, download template for -compressed_blobs")
+var verifyDownloads = flag.Bool("verify", false, "Verify hash of every downloaded blob, and download back every uploaded blob to verify it")
 
-func downloadFile(client bytestream.ByteStreamClient, size int64, sha256 string) error {
-	rn := strings.ReplaceAll(*downloadTpl, "{sha256}", sha256)
+// CorruptionError is returned when downloaded data does not match expected size or hash, so it can be reported
+// separately from other failures.
+type CorruptionError struct {
+	ResourceName string
+	Reason       string
+}
+
+func (e *CorruptionError) Error() string {
+	return fmt.Sprintf("Corrupted %s: %s", e.ResourceName, e.Reason)
+}
+
+func isCorruption(err error) bool {
+	var c *CorruptionError
+	return errors.As(err, &c)
+}
+
+// downloadFile downloads the blob and verifies its size, and hash if -verify is set.
+func downloadFile(client bytestream.ByteStreamClient, size int64, sha256 string) (Latency, error) {
+	tpl := *downloadTpl
+	if *compressedBlobs {
+		tpl = *compressedDownloadTpl
+	}
+	rn := resourceName(tpl, sha256)
 	rn = strings.ReplaceAll(rn, "{size}", strconv.FormatInt(size, 10))
 	//log.Printf("Downloading file, resource_name: %s", rn)
 
+	var l Latency
+	start := time.Now()
 	stream, err := client.Read(context.Background(), &bytestream.ReadRequest{ResourceName: rn})
 	if err != nil {
-		return err
+		return l, err
 	}
 
+	if *compressedBlobs {
+		l.First, err = decompressDownload(stream, rn, size, sha256, start)
+		l.Total = time.Now().Sub(start)
+		return l, err
+	}
+
+	var h hash.Hash
+	if *verifyDownloads {
+		h = newHash()
+	}
 	var read int64
 	for {
 		resp, err := stream.Recv()
+		if l.First == 0 {
+			l.First = time.Now().Sub(start)
+		}
 		if err == io.EOF {
 			break
 		}
 		if err != nil {
-			return err
+			l.Total = time.Now().Sub(start)
+			return l, err
 		}
 		read += int64(len(resp.GetData()))
+		if h != nil {
+			h.Write(resp.GetData())
+		}
 	}
 
+	l.Total = time.Now().Sub(start)
+
 	if read != size {
-		return errors.New(fmt.Sprintf("Read %d != expected size %d", read, size))
+		return l, &CorruptionError{rn, fmt.Sprintf("read %d != expected size %d", read, size)}
+	}
+	if h != nil {
+		if got := hex.EncodeToString(h.Sum(nil)); got != sha256 {
+			return l, &CorruptionError{rn, fmt.Sprintf("hash %s != expected %s", got, sha256)}
+		}
 	}
 
-	return nil
+	return l, nil
 }
 
+// decompressDownload decompresses and verifies compressed blob, returns time to first byte since start.
+func decompressDownload(stream bytestream.ByteStream_ReadClient, rn string, size int64, sha256 string, start time.Time) (time.Duration, error) {
+	h := newHash()
+	counter := &wcounter{out: h}
+	r := &readStreamReader{stream: stream}
+	if err := zstdDecompress(counter, r); err != nil {
+		return r.first.Sub(start), err
+	}
+	first := r.first.Sub(start)
+
+	if counter.n != size {
+		return first, &CorruptionError{rn, fmt.Sprintf("decompressed %d != expected size %d", counter.n, size)}
+	}
+	if got := hex.EncodeToString(h.Sum(nil)); got != sha256 {
+		return first, &CorruptionError{rn, fmt.Sprintf("decompressed hash %s != expected %s", got, sha256)}
+	}
+	return first, nil
+}
+
+// downloadRange downloads limit bytes of the blob starting at offset, up to the end of the blob if limit is 0.
+func downloadRange(client bytestream.ByteStreamClient, size int64, sha256 string, offset int64, limit int64) ([]byte, Latency, error) {
+	tpl := *downloadTpl
+	if *compressedBlobs {
+		tpl = *compressedDownloadTpl
+	}
+	rn := resourceName(tpl, sha256)
+	rn = strings.ReplaceAll(rn, "{size}", strconv.FormatInt(size, 10))
+
+	var l Latency
+	start := time.Now()
+	stream, err := client.Read(context.Background(), &bytestream.ReadRequest{ResourceName: rn, ReadOffset: offset, ReadLimit: limit})
+	if err != nil {
+		return nil, l, err
+	}
+
+	var buf bytes.Buffer
+	r := &readStreamReader{stream: stream}
+	if *compressedBlobs {
+		// Range of uncompressed data is sent compressed
+		err = zstdDecompress(&buf, r)
+	} else {
+		_, err = io.Copy(&buf, r)
+	}
+	l.First = r.first.Sub(start)
+	l.Total = time.Now().Sub(start)
+	return buf.Bytes(), l, err
+}
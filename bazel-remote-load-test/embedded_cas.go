@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// ContentAddressableStorage and ActionCache services of the embedded server, GetTree is not implemented.
+
+func (s *embeddedServer) FindMissingBlobs(_ context.Context, req *remoteexecution.FindMissingBlobsRequest) (*remoteexecution.FindMissingBlobsResponse, error) {
+	if err := checkRequestDigestFunction(req.DigestFunction); err != nil {
+		return nil, err
+	}
+	resp := &remoteexecution.FindMissingBlobsResponse{}
+	for _, d := range req.BlobDigests {
+		if !s.store.contains(d.Hash) {
+			resp.MissingBlobDigests = append(resp.MissingBlobDigests, d)
+		}
+	}
+	return resp, nil
+}
+
+func (s *embeddedServer) BatchUpdateBlobs(_ context.Context, req *remoteexecution.BatchUpdateBlobsRequest) (*remoteexecution.BatchUpdateBlobsResponse, error) {
+	if err := checkRequestDigestFunction(req.DigestFunction); err != nil {
+		return nil, err
+	}
+	resp := &remoteexecution.BatchUpdateBlobsResponse{}
+	for _, r := range req.Requests {
+		var err error
+		switch {
+		case r.Digest == nil:
+			err = status.Error(codes.InvalidArgument, "missing digest")
+		case r.Compressor == remoteexecution.Compressor_IDENTITY || r.Compressor == remoteexecution.Compressor_ZSTD:
+			if !s.store.contains(r.Digest.Hash) {
+				err = s.finishWrite(resource{hash: r.Digest.Hash, size: r.Digest.SizeBytes, compressed: r.Compressor == remoteexecution.Compressor_ZSTD}, r.Data)
+			}
+		default:
+			err = status.Errorf(codes.InvalidArgument, "unsupported compressor: %s", r.Compressor)
+		}
+		resp.Responses = append(resp.Responses, &remoteexecution.BatchUpdateBlobsResponse_Response{
+			Digest: r.Digest,
+			Status: status.Convert(err).Proto(),
+		})
+	}
+	return resp, nil
+}
+
+func (s *embeddedServer) BatchReadBlobs(_ context.Context, req *remoteexecution.BatchReadBlobsRequest) (*remoteexecution.BatchReadBlobsResponse, error) {
+	if err := checkRequestDigestFunction(req.DigestFunction); err != nil {
+		return nil, err
+	}
+	resp := &remoteexecution.BatchReadBlobsResponse{}
+	for _, d := range req.Digests {
+		data, ok, err := s.store.get(d.Hash)
+		if err == nil && !ok {
+			err = status.Errorf(codes.NotFound, "blob not found: %s", d.Hash)
+		} else if err != nil {
+			err = status.Error(codes.Internal, err.Error())
+		}
+		resp.Responses = append(resp.Responses, &remoteexecution.BatchReadBlobsResponse_Response{
+			Digest: d,
+			Data:   data,
+			Status: status.Convert(err).Proto(),
+		})
+	}
+	return resp, nil
+}
+
+func (s *embeddedServer) GetActionResult(_ context.Context, req *remoteexecution.GetActionResultRequest) (*remoteexecution.ActionResult, error) {
+	if err := checkRequestDigestFunction(req.DigestFunction); err != nil {
+		return nil, err
+	}
+	data, ok, err := s.store.getActionResult(req.ActionDigest.GetHash())
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "action result not found: %s", req.ActionDigest.GetHash())
+	}
+	ar := &remoteexecution.ActionResult{}
+	if err := proto.Unmarshal(data, ar); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return ar, nil
+}
+
+func (s *embeddedServer) UpdateActionResult(_ context.Context, req *remoteexecution.UpdateActionResultRequest) (*remoteexecution.ActionResult, error) {
+	if err := checkRequestDigestFunction(req.DigestFunction); err != nil {
+		return nil, err
+	}
+	if req.ActionDigest.GetHash() == "" || req.ActionResult == nil {
+		return nil, status.Error(codes.InvalidArgument, "missing action digest or action result")
+	}
+	data, err := proto.Marshal(req.ActionResult)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if err := s.store.putActionResult(req.ActionDigest.Hash, data); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return req.ActionResult, nil
+}
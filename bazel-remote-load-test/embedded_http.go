@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// embeddedHttpHandler serves bazel-remote HTTP cache protocol: GET, HEAD and PUT of {instance}/cas/{hash} and
+// {instance}/ac/{hash}, instance is optional. CAS blobs are sent zstd encoded if accepted, and can be uploaded
+// zstd encoded. Metrics of the store are served at /metrics without authentication.
+type embeddedHttpHandler struct {
+	store *embeddedStore
+}
+
+func (h *embeddedHttpHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/metrics" {
+		h.store.metrics.ServeHTTP(w, r)
+		return
+	}
+	if !checkEmbeddedHttpAuth(w, r) {
+		return
+	}
+
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	n := len(parts)
+	if n < 2 || (parts[n-2] != casKind && parts[n-2] != acKind) || len(parts[n-1]) != newHash().Size()*2 {
+		http.Error(w, "invalid path: "+r.URL.Path, http.StatusBadRequest)
+		return
+	}
+	kind, hash := parts[n-2], parts[n-1]
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		h.get(w, r, kind, hash)
+	case http.MethodPut:
+		h.put(w, r, kind, hash)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (h *embeddedHttpHandler) get(w http.ResponseWriter, r *http.Request, kind string, hash string) {
+	var data []byte
+	var ok bool
+	var err error
+	switch {
+	case kind == acKind:
+		data, ok, err = h.store.getActionResult(hash)
+	case strings.Contains(r.Header.Get("Accept-Encoding"), "zstd") && r.Header.Get("Range") == "":
+		if data, ok, err = h.store.getZstd(hash); ok {
+			w.Header().Set("Content-Encoding", "zstd")
+		}
+	default:
+		data, ok, err = h.store.get(hash)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	if kind == casKind && w.Header().Get("Content-Encoding") == "" {
+		// Handles Range requests
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+		return
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	if r.Method == http.MethodGet {
+		_, _ = w.Write(data)
+	}
+}
+
+func (h *embeddedHttpHandler) put(w http.ResponseWriter, r *http.Request, kind string, hash string) {
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if kind == acKind {
+		if err := h.store.putActionResult(hash, data); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	if r.Header.Get("Content-Encoding") == "zstd" {
+		if data, err = h.store.decompress(data); err != nil {
+			http.Error(w, "invalid zstd data: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	sum := newHash()
+	sum.Write(data)
+	if got := hex.EncodeToString(sum.Sum(nil)); got != hash {
+		http.Error(w, "uploaded data hash does not match: "+got, http.StatusBadRequest)
+		return
+	}
+	if err := h.store.put(hash, data); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
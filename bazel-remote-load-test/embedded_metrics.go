@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sync/atomic"
+)
+
+// Number of embedded_blob_size_bytes histogram buckets, besides +Inf, with upper bounds from 1KiB to 1GiB
+const embeddedSizeBucketCount = 11
+
+var embeddedSizeBuckets = func() []int64 {
+	b := make([]int64, embeddedSizeBucketCount)
+	for i := range b {
+		b[i] = 1 << (10 + 2*i)
+	}
+	return b
+}()
+
+// embeddedSizeHistogram counts sizes of blobs, in a bucket of the smallest upper bound which is not below the size.
+type embeddedSizeHistogram struct {
+	// Last one is +Inf
+	buckets [embeddedSizeBucketCount + 1]int64
+	sum     int64
+	count   int64
+}
+
+func (h *embeddedSizeHistogram) observe(size int64) {
+	i := 0
+	for i < len(embeddedSizeBuckets) && size > embeddedSizeBuckets[i] {
+		i++
+	}
+	atomic.AddInt64(&h.buckets[i], 1)
+	atomic.AddInt64(&h.sum, size)
+	atomic.AddInt64(&h.count, 1)
+}
+
+func (h *embeddedSizeHistogram) write(w io.Writer, labels string) {
+	var cumulative int64
+	for i, bound := range embeddedSizeBuckets {
+		cumulative += atomic.LoadInt64(&h.buckets[i])
+		fmt.Fprintf(w, "embedded_blob_size_bytes_bucket{%s,le=\"%d\"} %d\n", labels, bound, cumulative)
+	}
+	cumulative += atomic.LoadInt64(&h.buckets[len(embeddedSizeBuckets)])
+	fmt.Fprintf(w, "embedded_blob_size_bytes_bucket{%s,le=\"+Inf\"} %d\n", labels, cumulative)
+	fmt.Fprintf(w, "embedded_blob_size_bytes_sum{%s} %d\n", labels, atomic.LoadInt64(&h.sum))
+	fmt.Fprintf(w, "embedded_blob_size_bytes_count{%s} %d\n", labels, atomic.LoadInt64(&h.count))
+}
+
+// embeddedMetrics are counters of the embedded store, served in Prometheus text format at /metrics of the embedded
+// HTTP server, as a stand-in of metrics of bazel-remote.
+type embeddedMetrics struct {
+	hits      [2]int64
+	misses    [2]int64
+	evictions int64
+	evicted   int64
+	gets      [2]embeddedSizeHistogram
+	puts      [2]embeddedSizeHistogram
+}
+
+var embeddedKinds = [2]string{casKind, acKind}
+
+func embeddedKindIndex(kind string) int {
+	if kind == acKind {
+		return 1
+	}
+	return 0
+}
+
+func (m *embeddedMetrics) get(kind string, size int64, ok bool) {
+	i := embeddedKindIndex(kind)
+	if !ok {
+		atomic.AddInt64(&m.misses[i], 1)
+		return
+	}
+	atomic.AddInt64(&m.hits[i], 1)
+	m.gets[i].observe(size)
+}
+
+func (m *embeddedMetrics) put(kind string, size int64) {
+	m.puts[embeddedKindIndex(kind)].observe(size)
+}
+
+func (m *embeddedMetrics) evict(size int64) {
+	atomic.AddInt64(&m.evictions, 1)
+	atomic.AddInt64(&m.evicted, size)
+}
+
+func (m *embeddedMetrics) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	fmt.Fprintln(w, "# HELP embedded_cache_hits_total Number of reads of existing blobs.")
+	fmt.Fprintln(w, "# TYPE embedded_cache_hits_total counter")
+	for i, kind := range embeddedKinds {
+		fmt.Fprintf(w, "embedded_cache_hits_total{kind=%q} %d\n", kind, atomic.LoadInt64(&m.hits[i]))
+	}
+	fmt.Fprintln(w, "# HELP embedded_cache_misses_total Number of reads of missing blobs.")
+	fmt.Fprintln(w, "# TYPE embedded_cache_misses_total counter")
+	for i, kind := range embeddedKinds {
+		fmt.Fprintf(w, "embedded_cache_misses_total{kind=%q} %d\n", kind, atomic.LoadInt64(&m.misses[i]))
+	}
+	fmt.Fprintln(w, "# HELP embedded_cache_evictions_total Number of evicted blobs.")
+	fmt.Fprintln(w, "# TYPE embedded_cache_evictions_total counter")
+	fmt.Fprintf(w, "embedded_cache_evictions_total %d\n", atomic.LoadInt64(&m.evictions))
+	fmt.Fprintln(w, "# HELP embedded_cache_evicted_bytes_total Stored size of evicted blobs.")
+	fmt.Fprintln(w, "# TYPE embedded_cache_evicted_bytes_total counter")
+	fmt.Fprintf(w, "embedded_cache_evicted_bytes_total %d\n", atomic.LoadInt64(&m.evicted))
+	fmt.Fprintln(w, "# HELP embedded_blob_size_bytes Stored size of read and written blobs.")
+	fmt.Fprintln(w, "# TYPE embedded_blob_size_bytes histogram")
+	for i, kind := range embeddedKinds {
+		m.gets[i].write(w, fmt.Sprintf("kind=%q,op=\"get\"", kind))
+		m.puts[i].write(w, fmt.Sprintf("kind=%q,op=\"put\"", kind))
+	}
+}
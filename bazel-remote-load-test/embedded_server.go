@@ -0,0 +1,319 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/hex"
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/dustin/go-humanize"
+	"google.golang.org/genproto/googleapis/bytestream"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const embeddedAddr = "embedded"
+const embeddedReadChunkSize = 1 << 20
+
+// Embedded server runs in this process, so its CPU time is included in the client's
+var embeddedServerStarted bool
+
+// embeddedServer is a minimal in-process stand-in of bazel-remote ByteStream, ContentAddressableStorage and
+// ActionCache services, so the load test can be used without a real server.
+type embeddedServer struct {
+	remoteexecution.UnimplementedContentAddressableStorageServer
+	store *embeddedStore
+
+	mu sync.Mutex
+	// Writes which were started, but not finished yet, by resource name
+	uploads map[string]*embeddedUpload
+}
+
+// embeddedUpload is data received by a write, locked while a stream writes to it, so a resumed write or
+// QueryWriteStatus waits until an interrupted stream is done.
+type embeddedUpload struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+type resource struct {
+	hash string
+	// Uncompressed size
+	size int64
+	// Data is sent as zstd compressed-blobs
+	compressed bool
+}
+
+// parseResourceName parses hash and size from "{instance}/blobs/{hash}/{size}",
+// "{instance}/uploads/{uuid}/blobs/{hash}/{size}" and corresponding "compressed-blobs/zstd/{hash}/{size}"
+// resource names, instance name is optional. Hash may be preceded by digest function name, which must be
+// -digest_function, same as the hash length.
+func parseResourceName(rn string) (resource, error) {
+	parts := strings.Split(rn, "/")
+	n := len(parts)
+	var r resource
+	fn := ""
+	if n >= 3 && digestFunctions[parts[n-3]] != nil {
+		fn = parts[n-3]
+		parts = append(parts[:n-3:n-3], parts[n-2:]...)
+		n--
+	}
+	if fn == "" && !legacyDigestFunctions[*digestFunction] || fn != "" && fn != *digestFunction {
+		return r, status.Errorf(codes.InvalidArgument, "digest function of resource name is not %s: %s", *digestFunction, rn)
+	}
+	switch {
+	case n >= 3 && parts[n-3] == "blobs":
+	case n >= 4 && parts[n-4] == "compressed-blobs":
+		if parts[n-3] != "zstd" {
+			return r, status.Errorf(codes.InvalidArgument, "unsupported compressor in resource name: %s", rn)
+		}
+		r.compressed = true
+	default:
+		return r, status.Errorf(codes.InvalidArgument, "invalid resource name: %s", rn)
+	}
+
+	r.hash = parts[n-2]
+	if len(r.hash) != newHash().Size()*2 {
+		return r, status.Errorf(codes.InvalidArgument, "invalid %s hash in resource name: %s", *digestFunction, rn)
+	}
+	size, err := strconv.ParseInt(parts[n-1], 10, 64)
+	if err != nil || size < 0 {
+		return r, status.Errorf(codes.InvalidArgument, "invalid size in resource name: %s", rn)
+	}
+	r.size = size
+	return r, nil
+}
+
+func newEmbeddedServer(store *embeddedStore) *embeddedServer {
+	return &embeddedServer{store: store, uploads: make(map[string]*embeddedUpload)}
+}
+
+// startEmbeddedServer starts gRPC and HTTP servers sharing the store, listening on random local ports, and returns
+// their addresses.
+func startEmbeddedServer() (string, string) {
+	embeddedServerStarted = true
+	lis, err := net.Listen("tcp", "localhost:0")
+	noError(err)
+	httpLis, err := net.Listen("tcp", "localhost:0")
+	noError(err)
+
+	var maxSize uint64
+	if *embeddedMaxSize != "" {
+		if maxSize, err = humanize.ParseBytes(*embeddedMaxSize); err != nil {
+			log.Fatalf("Invalid embedded server max size: %s", *embeddedMaxSize)
+		}
+	}
+	store := newEmbeddedStore(*embeddedDir, *embeddedStorageMode, *embeddedZstdImpl, int64(maxSize))
+	opts := append(grpcServerOptions(), grpc.UnaryInterceptor(embeddedAuthUnary), grpc.StreamInterceptor(embeddedAuthStream))
+	if *useTls {
+		cfg := embeddedTlsConfig()
+		opts = append(opts, grpc.Creds(credentials.NewTLS(cfg)))
+		httpLis = tls.NewListener(httpLis, cfg)
+	}
+	s := grpc.NewServer(opts...)
+	srv := newEmbeddedServer(store)
+	bytestream.RegisterByteStreamServer(s, srv)
+	remoteexecution.RegisterContentAddressableStorageServer(s, srv)
+	remoteexecution.RegisterActionCacheServer(s, srv)
+	go func() {
+		noError(s.Serve(lis))
+	}()
+	go func() {
+		noError(http.Serve(httpLis, &embeddedHttpHandler{store: store}))
+	}()
+
+	storage := "memory"
+	if *embeddedDir != "" {
+		storage = *embeddedDir
+	}
+	if maxSize > 0 {
+		storage += ", max size: " + humanize.IBytes(maxSize)
+	}
+	log.Printf("Started embedded server at %s, http: %s, storage: %s, storage mode: %s, zstd implementation: %s, tls: %t, mtls: %t",
+		lis.Addr(), httpLis.Addr(), storage, *embeddedStorageMode, *embeddedZstdImpl, *useTls, *useTls && *embeddedMtls)
+	return lis.Addr().String(), httpLis.Addr().String()
+}
+
+func (s *embeddedServer) Read(req *bytestream.ReadRequest, stream bytestream.ByteStream_ReadServer) error {
+	r, err := parseResourceName(req.ResourceName)
+	if err != nil {
+		return err
+	}
+	var data []byte
+	var ok bool
+	if r.compressed && req.ReadOffset == 0 && req.ReadLimit == 0 {
+		data, ok, err = s.store.getZstd(r.hash)
+	} else {
+		data, ok, err = s.store.get(r.hash)
+	}
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	if !ok {
+		return status.Errorf(codes.NotFound, "blob not found: %s", r.hash)
+	}
+	if r.compressed && (req.ReadOffset != 0 || req.ReadLimit != 0) {
+		// Offset and limit are applied to uncompressed data, which is compressed again
+		if data, err = s.readRange(data, req.ReadOffset, req.ReadLimit); err != nil {
+			return err
+		}
+		if data, err = s.store.compress(data); err != nil {
+			return status.Error(codes.Internal, err.Error())
+		}
+	} else if data, err = s.readRange(data, req.ReadOffset, req.ReadLimit); err != nil {
+		return err
+	}
+
+	for len(data) > 0 {
+
+		n := embeddedReadChunkSize
+		if n > len(data) {
+			n = len(data)
+		}
+		if err := stream.Send(&bytestream.ReadResponse{Data: data[:n]}); err != nil {
+			return err
+		}
+		data = data[n:]
+	}
+	return nil
+}
+
+func (s *embeddedServer) readRange(data []byte, offset int64, limit int64) ([]byte, error) {
+	if offset < 0 || offset > int64(len(data)) {
+		return nil, status.Errorf(codes.OutOfRange, "invalid read offset %d for blob of size %d", offset, len(data))
+	}
+	if limit < 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "negative read limit: %d", limit)
+	}
+	data = data[offset:]
+	if limit > 0 && limit < int64(len(data)) {
+		data = data[:limit]
+	}
+	return data, nil
+}
+
+func (s *embeddedServer) finishWrite(r resource, data []byte) error {
+	if r.compressed {
+		var err error
+		if data, err = s.store.decompress(data); err != nil {
+			return status.Errorf(codes.InvalidArgument, "invalid zstd data: %s", err)
+		}
+	}
+	if int64(len(data)) != r.size {
+		return status.Errorf(codes.InvalidArgument, "uploaded size %d != expected size %d", len(data), r.size)
+	}
+	h := newHash()
+	h.Write(data)
+	if got := hex.EncodeToString(h.Sum(nil)); got != r.hash {
+		return status.Errorf(codes.InvalidArgument, "uploaded data hash %s != expected hash %s", got, r.hash)
+	}
+	if err := s.store.put(r.hash, data); err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	return nil
+}
+
+func (s *embeddedServer) Write(stream bytestream.ByteStream_WriteServer) error {
+	req, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	rn := req.ResourceName
+	r, err := parseResourceName(rn)
+	if err != nil {
+		return err
+	}
+
+	if s.store.contains(r.hash) {
+		// Same as bazel-remote, respond early if the blob already exists, with -1 for compressed uploads
+		committed := r.size
+		if r.compressed {
+			committed = -1
+		}
+		return stream.SendAndClose(&bytestream.WriteResponse{CommittedSize: committed})
+	}
+
+	// Continue a previously interrupted write, or start a new one
+	s.mu.Lock()
+	u, ok := s.uploads[rn]
+	if !ok {
+		u = &embeddedUpload{}
+		s.uploads[rn] = u
+	}
+	s.mu.Unlock()
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	buf := &u.buf
+
+	// Only writes closed by the client can be resumed, writes abandoned by a stream error are forgotten
+	resumable := false
+	defer func() {
+		if resumable {
+			return
+		}
+		s.mu.Lock()
+		if s.uploads[rn] == u {
+			delete(s.uploads, rn)
+		}
+		s.mu.Unlock()
+	}()
+
+	for {
+		if req.WriteOffset != int64(buf.Len()) {
+			return status.Errorf(codes.InvalidArgument, "write offset %d != committed size %d", req.WriteOffset, buf.Len())
+		}
+		if !r.compressed && int64(buf.Len()+len(req.Data)) > r.size {
+			return status.Errorf(codes.InvalidArgument, "too much data for blob of size %d", r.size)
+		}
+		buf.Write(req.Data)
+
+		if req.FinishWrite {
+			if err := s.finishWrite(r, buf.Bytes()); err != nil {
+				return err
+			}
+			return stream.SendAndClose(&bytestream.WriteResponse{CommittedSize: int64(buf.Len())})
+		}
+
+		req, err = stream.Recv()
+		if err == io.EOF {
+			// Client closed the stream without finishing the write, it can be resumed later
+			resumable = true
+			return stream.SendAndClose(&bytestream.WriteResponse{CommittedSize: int64(buf.Len())})
+		}
+		if err != nil {
+			return err
+		}
+		if req.ResourceName != "" && req.ResourceName != rn {
+			return status.Errorf(codes.InvalidArgument, "resource name changed during write: %s", req.ResourceName)
+		}
+	}
+}
+
+func (s *embeddedServer) QueryWriteStatus(_ context.Context, req *bytestream.QueryWriteStatusRequest) (*bytestream.QueryWriteStatusResponse, error) {
+	r, err := parseResourceName(req.ResourceName)
+	if err != nil {
+		return nil, err
+	}
+	if s.store.contains(r.hash) {
+		return &bytestream.QueryWriteStatusResponse{CommittedSize: r.size, Complete: true}, nil
+	}
+
+	s.mu.Lock()
+	u, ok := s.uploads[req.ResourceName]
+	s.mu.Unlock()
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "write not found: %s", req.ResourceName)
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return &bytestream.QueryWriteStatusResponse{CommittedSize: int64(u.buf.Len())}, nil
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"google.golang.org/genproto/googleapis/bytestream"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// serveTestServer serves an embedded server with the storage mode on a local port, and returns it with a client.
+func serveTestServer(t *testing.T, storageMode string) (*embeddedServer, *Client) {
+	lis, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := newEmbeddedServer(newEmbeddedStore("", storageMode, "go", 0))
+	s := grpc.NewServer()
+	bytestream.RegisterByteStreamServer(s, srv)
+	remoteexecution.RegisterContentAddressableStorageServer(s, srv)
+	remoteexecution.RegisterActionCacheServer(s, srv)
+	go func() {
+		_ = s.Serve(lis)
+	}()
+	t.Cleanup(s.Stop)
+
+	conn, err := grpc.Dial(lis.Addr().String(), grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	return srv, &Client{Transport: newGrpcTransport(conn), CAS: remoteexecution.NewContentAddressableStorageClient(conn)}
+}
+
+// setBool sets the flag for the test.
+func setBool(t *testing.T, flag *bool, v bool) {
+	old := *flag
+	*flag = v
+	t.Cleanup(func() { *flag = old })
+}
+
+func setFloat(t *testing.T, flag *float64, v float64) {
+	old := *flag
+	*flag = v
+	t.Cleanup(func() { *flag = old })
+}
+
+// testBlob returns compressible random data of given size and its hash.
+func testBlob(size int) ([]byte, string) {
+	data := make([]byte, size)
+	r := rand.New(rand.NewSource(int64(size)))
+	for i := range data {
+		data[i] = byte('a' + r.Intn(4))
+	}
+	h := newHash()
+	h.Write(data)
+	return data, hex.EncodeToString(h.Sum(nil))
+}
+
+func openBytes(data []byte) uploadSource {
+	return func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(data)), nil
+	}
+}
+
+var testSizes = []int{0, 1, 100 << 10, 3<<20 + 7}
+
+func TestEmbeddedRoundTrip(t *testing.T) {
+	setBool(t, verifyDownloads, true)
+	for _, storageMode := range []string{"uncompressed", "zstd"} {
+		for _, compressed := range []bool{false, true} {
+			_, client := serveTestServer(t, storageMode)
+			setBool(t, compressedBlobs, compressed)
+			for _, size := range testSizes {
+				data, hash := testBlob(size)
+				if _, err := client.Upload(openBytes(data), int64(size), hash); err != nil {
+					t.Fatalf("storage mode: %s, compressed: %t, size: %d, upload: %s", storageMode, compressed, size, err)
+				}
+				if _, err := client.Download(int64(size), hash); err != nil {
+					t.Fatalf("storage mode: %s, compressed: %t, size: %d, download: %s", storageMode, compressed, size, err)
+				}
+				// Existing blob is not uploaded again
+				if _, err := client.Upload(openBytes(data), int64(size), hash); err != nil {
+					t.Fatalf("storage mode: %s, compressed: %t, size: %d, second upload: %s", storageMode, compressed, size, err)
+				}
+			}
+		}
+	}
+}
+
+func TestEmbeddedMismatchedUpload(t *testing.T) {
+	_, client := serveTestServer(t, "uncompressed")
+	data, _ := testBlob(1000)
+	_, other := testBlob(1001)
+	if _, err := client.Upload(openBytes(data), 1000, other); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expected invalid argument for wrong hash, got: %v", err)
+	}
+	if _, err := client.Download(1000, other); status.Code(err) != codes.NotFound {
+		t.Fatalf("expected not found, got: %v", err)
+	}
+}
+
+func TestEmbeddedRangedReads(t *testing.T) {
+	for _, storageMode := range []string{"uncompressed", "zstd"} {
+		for _, compressed := range []bool{false, true} {
+			_, client := serveTestServer(t, storageMode)
+			setBool(t, compressedBlobs, compressed)
+			size := 3<<20 + 7
+			data, hash := testBlob(size)
+			if _, err := client.Upload(openBytes(data), int64(size), hash); err != nil {
+				t.Fatal(err)
+			}
+			for _, r := range []struct{ offset, limit int64 }{
+				{0, 0},
+				{0, 1},
+				{1000, 64 << 10},
+				{int64(size) - 10, 0},
+				{int64(size) - 10, 100},
+				{int64(size), 0},
+			} {
+				got, _, err := client.DownloadRange(int64(size), hash, r.offset, r.limit)
+				if err != nil {
+					t.Fatalf("storage mode: %s, compressed: %t, offset: %d, limit: %d: %s", storageMode, compressed, r.offset, r.limit, err)
+				}
+				want := data[r.offset:]
+				if r.limit > 0 && r.limit < int64(len(want)) {
+					want = want[:r.limit]
+				}
+				if !bytes.Equal(got, want) {
+					t.Fatalf("storage mode: %s, compressed: %t, offset: %d, limit: %d: got %d bytes, want %d", storageMode,
+						compressed, r.offset, r.limit, len(got), len(want))
+				}
+			}
+			if _, _, err := client.DownloadRange(int64(size), hash, int64(size)+1, 0); status.Code(err) != codes.OutOfRange {
+				t.Fatalf("expected out of range, got: %v", err)
+			}
+		}
+	}
+}
+
+func TestEmbeddedInterruptedUpload(t *testing.T) {
+	setBool(t, verifyDownloads, true)
+	setFloat(t, interruptUploads, 1)
+	for _, compressed := range []bool{false, true} {
+		_, client := serveTestServer(t, "uncompressed")
+		setBool(t, compressedBlobs, compressed)
+		data, hash := testBlob(3 << 20)
+		if _, err := client.Upload(openBytes(data), int64(len(data)), hash); err != nil {
+			t.Fatalf("compressed: %t, upload: %s", compressed, err)
+		}
+		if _, err := client.Download(int64(len(data)), hash); err != nil {
+			t.Fatalf("compressed: %t, download: %s", compressed, err)
+		}
+	}
+}
+
+// noQueryServer is a server which does not support resuming uploads.
+type noQueryServer struct {
+	*embeddedServer
+}
+
+func (noQueryServer) QueryWriteStatus(context.Context, *bytestream.QueryWriteStatusRequest) (*bytestream.QueryWriteStatusResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "QueryWriteStatus is not implemented")
+}
+
+func TestInterruptedUploadWithoutQueryWriteStatus(t *testing.T) {
+	setBool(t, verifyDownloads, true)
+	setFloat(t, interruptUploads, 1)
+	lis, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := grpc.NewServer()
+	bytestream.RegisterByteStreamServer(s, noQueryServer{newEmbeddedServer(newEmbeddedStore("", "uncompressed", "go", 0))})
+	go func() {
+		_ = s.Serve(lis)
+	}()
+	defer s.Stop()
+	conn, err := grpc.Dial(lis.Addr().String(), grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := &Client{Transport: newGrpcTransport(conn)}
+
+	atomic.StoreInt64(&unsupportedQueries, 0)
+	data, hash := testBlob(3 << 20)
+	if _, err := client.Upload(openBytes(data), int64(len(data)), hash); err != nil {
+		t.Fatalf("upload: %s", err)
+	}
+	if _, err := client.Download(int64(len(data)), hash); err != nil {
+		t.Fatalf("download: %s", err)
+	}
+	if atomic.LoadInt64(&unsupportedQueries) != 1 {
+		t.Fatalf("expected restarted upload, unsupported queries: %d", atomic.LoadInt64(&unsupportedQueries))
+	}
+}
+
+func TestEmbeddedCancelledUpload(t *testing.T) {
+	setFloat(t, cancelUploads, 1)
+	srv, client := serveTestServer(t, "uncompressed")
+	data, hash := testBlob(3 << 20)
+	if _, err := client.Upload(openBytes(data), int64(len(data)), hash); err != errUploadCancelled {
+		t.Fatalf("expected cancelled upload, got: %v", err)
+	}
+
+	// Abandoned write is forgotten once the server sees the cancelled stream
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		srv.mu.Lock()
+		n := len(srv.uploads)
+		srv.mu.Unlock()
+		if n == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("abandoned writes were not removed: %d", n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, err := client.Download(int64(len(data)), hash); status.Code(err) != codes.NotFound {
+		t.Fatalf("expected not found, got: %v", err)
+	}
+}
+
+func TestParseResourceName(t *testing.T) {
+	hash := strings.Repeat("ab", 32)
+	for _, tc := range []struct {
+		rn         string
+		want       resource
+		wantErrors bool
+	}{
+		{rn: "blobs/" + hash + "/123", want: resource{hash: hash, size: 123}},
+		{rn: "instance/blobs/" + hash + "/0", want: resource{hash: hash}},
+		{rn: "a/b/uploads/uuid/blobs/" + hash + "/5", want: resource{hash: hash, size: 5}},
+		{rn: "instance/compressed-blobs/zstd/" + hash + "/5", want: resource{hash: hash, size: 5, compressed: true}},
+		{rn: "instance/uploads/uuid/compressed-blobs/zstd/" + hash + "/5", want: resource{hash: hash, size: 5, compressed: true}},
+		{rn: "instance/blobs/sha256/" + hash + "/5", want: resource{hash: hash, size: 5}},
+		{rn: "instance/compressed-blobs/zstd/sha256/" + hash + "/5", want: resource{hash: hash, size: 5, compressed: true}},
+		{rn: "instance/blobs/blake3/" + hash + "/5", wantErrors: true},
+		{rn: "instance/compressed-blobs/gzip/" + hash + "/5", wantErrors: true},
+		{rn: "instance/blobs/" + hash[2:] + "/5", wantErrors: true},
+		{rn: "instance/blobs/" + hash + "/-1", wantErrors: true},
+		{rn: "instance/blobs/" + hash + "/x", wantErrors: true},
+		{rn: "instance/cas/" + hash + "/5", wantErrors: true},
+		{rn: hash + "/5", wantErrors: true},
+	} {
+		got, err := parseResourceName(tc.rn)
+		if tc.wantErrors {
+			if status.Code(err) != codes.InvalidArgument {
+				t.Errorf("%s: expected invalid argument, got: %v", tc.rn, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", tc.rn, err)
+		} else if got != tc.want {
+			t.Errorf("%s: got %+v, want %+v", tc.rn, got, tc.want)
+		}
+	}
+}
+
+func setString(t *testing.T, flag *string, v string) {
+	old := *flag
+	*flag = v
+	t.Cleanup(func() { *flag = old })
+}
+
+// testFiles writes blobs of testSizes to a temporary directory, and returns them as files of the load test.
+func testFiles(t *testing.T) []*FileData {
+	dir := t.TempDir()
+	var files []*FileData
+	for _, size := range testSizes {
+		data, _ := testBlob(size)
+		path := filepath.Join(dir, strconv.Itoa(size))
+		if err := ioutil.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		state, _, hash := getFileHash(path)
+		files = append(files, &FileData{Path: path, Size: int64(size), Hash: hash, HashState: state})
+	}
+	return files
+}
+
+func TestEmbeddedDigestFunctions(t *testing.T) {
+	for name := range digestFunctions {
+		setString(t, digestFunction, name)
+		_, client := serveTestServer(t, "uncompressed")
+		files := testFiles(t)
+		for _, f := range files {
+			if err := uploadFile(client, f.Path, f.Size, f.Hash); err != nil {
+				t.Fatalf("%s: upload: %s", name, err)
+			}
+		}
+		for _, batch := range getBatches(files) {
+			if err := casBatch(client, batch); err != nil {
+				t.Fatalf("%s: CAS batch: %s", name, err)
+			}
+			if err := acAction(client, batch); err != nil {
+				t.Fatalf("%s: AC action: %s", name, err)
+			}
+		}
+
+		// BLAKE3 hash can not be told from SHA-256 by length, so requests without digest function are rejected
+		_, err := client.CAS.FindMissingBlobs(context.Background(), &remoteexecution.FindMissingBlobsRequest{
+			BlobDigests: []*remoteexecution.Digest{{Hash: files[0].Hash, SizeBytes: files[0].Size}},
+		})
+		if legacyDigestFunctions[name] && err != nil {
+			t.Fatalf("%s: FindMissingBlobs without digest function: %s", name, err)
+		}
+		if !legacyDigestFunctions[name] && status.Code(err) != codes.InvalidArgument {
+			t.Fatalf("%s: expected invalid argument without digest function, got: %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"container/list"
+	zstdcgo "github.com/DataDog/zstd"
+	"github.com/klauspost/compress/zstd"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+)
+import "flag"
+
+var embeddedDir = flag.String("embedded_dir", "", "Directory to store blobs of the embedded server, in memory if empty")
+var embeddedStorageMode = flag.String("embedded_storage_mode", "uncompressed", "Storage mode of the embedded server: uncompressed or zstd")
+var embeddedZstdImpl = flag.String("embedded_zstd_implementation", "go", "Zstd implementation of the embedded server: go or cgo")
+var embeddedMaxSize = flag.String("embedded_max_size", "", "Capacity of the embedded server, e.g. 1GiB, least recently used blobs are evicted above it, unlimited if empty")
+
+const (
+	casKind = "cas"
+	acKind  = "ac"
+)
+
+// embeddedStore keeps blobs of the embedded server by hash, in memory or on disk, optionally compressed with zstd.
+// Action results are kept separately, uncompressed.
+type embeddedStore struct {
+	dir  string
+	zstd bool
+	cgo  bool
+
+	mu sync.RWMutex
+	// By kind and hash
+	blobs map[string][]byte
+
+	encoder *zstd.Encoder
+	decoder *zstd.Decoder
+
+	// Least recently used blobs are evicted if stored size is above maxSize, unless it is 0. Only blobs stored by
+	// this process are tracked.
+	maxSize    int64
+	lruMu      sync.Mutex
+	lru        *list.List
+	lruEntries map[string]*list.Element
+	used       int64
+
+	metrics embeddedMetrics
+}
+
+type lruEntry struct {
+	key  string
+	size int64
+}
+
+func newEmbeddedStore(dir string, storageMode string, zstdImpl string, maxSize int64) *embeddedStore {
+	s := &embeddedStore{dir: dir, blobs: make(map[string][]byte), maxSize: maxSize, lru: list.New(),
+		lruEntries: make(map[string]*list.Element)}
+	switch storageMode {
+	case "uncompressed":
+	case "zstd":
+		s.zstd = true
+	default:
+		log.Fatalf("Unknown embedded server storage mode: %s", storageMode)
+	}
+	switch zstdImpl {
+	case "go":
+		var err error
+		// EncodeAll and DecodeAll can be used concurrently
+		s.encoder, err = zstd.NewWriter(nil)
+		noError(err)
+		s.decoder, err = zstd.NewReader(nil)
+		noError(err)
+	case "cgo":
+		s.cgo = true
+	default:
+		log.Fatalf("Unknown embedded server zstd implementation: %s", zstdImpl)
+	}
+	if dir != "" {
+		noError(os.MkdirAll(filepath.Join(dir, casKind), 0755))
+		noError(os.MkdirAll(filepath.Join(dir, acKind), 0755))
+	}
+	return s
+}
+
+func (s *embeddedStore) path(kind string, hash string) string {
+	return filepath.Join(s.dir, kind, hash)
+}
+
+func (s *embeddedStore) compress(data []byte) ([]byte, error) {
+	if s.cgo {
+		return zstdcgo.Compress(nil, data)
+	}
+	return s.encoder.EncodeAll(data, nil), nil
+}
+
+func (s *embeddedStore) decompress(data []byte) ([]byte, error) {
+	if s.cgo {
+		return zstdcgo.Decompress(nil, data)
+	}
+	return s.decoder.DecodeAll(data, nil)
+}
+
+func (s *embeddedStore) contains(hash string) bool {
+	if s.dir != "" {
+		_, err := os.Stat(s.path(casKind, hash))
+		return err == nil
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	_, ok := s.blobs[casKind+"/"+hash]
+	return ok
+}
+
+// get returns uncompressed blob, ok is false if it does not exist.
+func (s *embeddedStore) get(hash string) (data []byte, ok bool, err error) {
+	data, ok, err = s.getStored(casKind, hash)
+	if err != nil || !ok || !s.zstd {
+		return
+	}
+	data, err = s.decompress(data)
+	return
+}
+
+// getZstd returns zstd compressed blob, ok is false if it does not exist.
+func (s *embeddedStore) getZstd(hash string) (data []byte, ok bool, err error) {
+	data, ok, err = s.getStored(casKind, hash)
+	if err != nil || !ok || s.zstd {
+		return
+	}
+	data, err = s.compress(data)
+	return
+}
+
+// getActionResult returns serialized action result, ok is false if it does not exist.
+func (s *embeddedStore) getActionResult(hash string) ([]byte, bool, error) {
+	return s.getStored(acKind, hash)
+}
+
+func (s *embeddedStore) getStored(kind string, hash string) ([]byte, bool, error) {
+	var data []byte
+	var ok bool
+	if s.dir != "" {
+		var err error
+		data, err = ioutil.ReadFile(s.path(kind, hash))
+		if os.IsNotExist(err) {
+			return nil, false, nil
+		}
+		if err != nil {
+			return nil, false, err
+		}
+		ok = true
+	} else {
+		s.mu.RLock()
+		data, ok = s.blobs[kind+"/"+hash]
+		s.mu.RUnlock()
+	}
+	if ok {
+		s.touch(kind + "/" + hash)
+	}
+	s.metrics.get(kind, int64(len(data)), ok)
+	return data, ok, nil
+}
+
+// touch marks the blob as recently used.
+func (s *embeddedStore) touch(key string) {
+	if s.maxSize == 0 {
+		return
+	}
+	s.lruMu.Lock()
+	defer s.lruMu.Unlock()
+	if e, ok := s.lruEntries[key]; ok {
+		s.lru.MoveToFront(e)
+	}
+}
+
+// added records size of a stored blob, and evicts least recently used blobs while stored size is above maxSize.
+func (s *embeddedStore) added(key string, size int64) {
+	if s.maxSize == 0 {
+		return
+	}
+	s.lruMu.Lock()
+	defer s.lruMu.Unlock()
+	if e, ok := s.lruEntries[key]; ok {
+		s.used -= e.Value.(*lruEntry).size
+		s.lru.Remove(e)
+	}
+	s.lruEntries[key] = s.lru.PushFront(&lruEntry{key, size})
+	s.used += size
+
+	for s.used > s.maxSize && s.lru.Len() > 1 {
+		e := s.lru.Back()
+		entry := e.Value.(*lruEntry)
+		s.lru.Remove(e)
+		delete(s.lruEntries, entry.key)
+		s.used -= entry.size
+		s.metrics.evict(entry.size)
+		if s.dir != "" {
+			_ = os.Remove(filepath.Join(s.dir, entry.key))
+		} else {
+			s.mu.Lock()
+			delete(s.blobs, entry.key)
+			s.mu.Unlock()
+		}
+	}
+}
+
+func (s *embeddedStore) put(hash string, data []byte) error {
+	stored := data
+	if s.zstd {
+		var err error
+		if stored, err = s.compress(data); err != nil {
+			return err
+		}
+	}
+	return s.putStored(casKind, hash, stored)
+}
+
+func (s *embeddedStore) putActionResult(hash string, data []byte) error {
+	return s.putStored(acKind, hash, data)
+}
+
+func (s *embeddedStore) putStored(kind string, hash string, stored []byte) error {
+	s.metrics.put(kind, int64(len(stored)))
+	if s.dir == "" {
+		s.mu.Lock()
+		s.blobs[kind+"/"+hash] = stored
+		s.mu.Unlock()
+		s.added(kind+"/"+hash, int64(len(stored)))
+		return nil
+	}
+
+	// Rename, so concurrent readers never see partially written blob
+	f, err := ioutil.TempFile(filepath.Join(s.dir, kind), hash+".tmp*")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(stored); err != nil {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		_ = os.Remove(f.Name())
+		return err
+	}
+	if err := os.Rename(f.Name(), s.path(kind, hash)); err != nil {
+		return err
+	}
+	s.added(kind+"/"+hash, int64(len(stored)))
+	return nil
+}
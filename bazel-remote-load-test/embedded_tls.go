@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"math/big"
+	"net"
+	"net/http"
+	"time"
+)
+import "flag"
+
+var embeddedMtls = flag.Bool("embedded_mtls", false, "Embedded server with -tls requires client certificates signed by its generated CA")
+
+// generateCert creates a certificate valid for localhost, signed by parent, self-signed if parent is nil.
+func generateCert(name string, serial int64, parent *tls.Certificate) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	noError(err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	parentTemplate, parentKey := template, interface{}(key)
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		parentTemplate, err = x509.ParseCertificate(parent.Certificate[0])
+		noError(err)
+		parentKey = parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parentTemplate, &key.PublicKey, parentKey)
+	noError(err)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// embeddedTlsConfig generates a CA with server and client certificates, and makes clients trust the CA and use the
+// client certificate unless -tls_ca_file and -tls_cert_file are given.
+func embeddedTlsConfig() *tls.Config {
+	ca := generateCert("embedded CA", 1, nil)
+	server := generateCert("embedded server", 2, &ca)
+	client := generateCert("embedded client", 3, &ca)
+
+	caCert, err := x509.ParseCertificate(ca.Certificate[0])
+	noError(err)
+	embeddedCa = x509.NewCertPool()
+	embeddedCa.AddCert(caCert)
+	embeddedClientCert = &client
+
+	cfg := &tls.Config{Certificates: []tls.Certificate{server}, ClientCAs: embeddedCa}
+	if *embeddedMtls {
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return cfg
+}
+
+func checkEmbeddedAuth(ctx context.Context) error {
+	expected := authHeader()
+	if expected == "" {
+		return nil
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	if values := md.Get("authorization"); len(values) != 1 || values[0] != expected {
+		return status.Error(codes.Unauthenticated, "missing or invalid authorization metadata")
+	}
+	return nil
+}
+
+func embeddedAuthUnary(ctx context.Context, req interface{}, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if err := checkEmbeddedAuth(ctx); err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+func embeddedAuthStream(srv interface{}, stream grpc.ServerStream, _ *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if err := checkEmbeddedAuth(stream.Context()); err != nil {
+		return err
+	}
+	return handler(srv, stream)
+}
+
+func checkEmbeddedHttpAuth(w http.ResponseWriter, r *http.Request) bool {
+	expected := authHeader()
+	if expected == "" || r.Header.Get("Authorization") == expected {
+		return true
+	}
+	if *httpUser != "" {
+		w.Header().Set("WWW-Authenticate", `Basic realm="embedded"`)
+	} else {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="embedded"`)
+	}
+	http.Error(w, "unauthorized", http.StatusUnauthorized)
+	return false
+}
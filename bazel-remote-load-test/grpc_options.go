@@ -0,0 +1,195 @@
+package main
+
+import (
+	"github.com/dustin/go-humanize"
+	"github.com/klauspost/compress/zstd"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/encoding"
+	_ "google.golang.org/grpc/encoding/gzip"
+	"google.golang.org/grpc/keepalive"
+	"io"
+	"log"
+	"sync"
+	"time"
+)
+import "flag"
+
+var connections = flag.Int("connections", 0, "Number of connections shared round-robin by all clients, 0 for a connection per client")
+var grpcMaxMsgSize = flag.Int("grpc_max_msg_size", 0, "Max gRPC message size sent and received by the client and the embedded server, 0 for gRPC default")
+var grpcWindowSize = flag.Int("grpc_initial_window_size", 0, "Initial gRPC stream window size, 0 for gRPC default with dynamic window")
+var grpcConnWindowSize = flag.Int("grpc_initial_conn_window_size", 0, "Initial gRPC connection window size, 0 for gRPC default with dynamic window")
+var grpcKeepaliveTime = flag.Duration("grpc_keepalive_time", 0, "Interval of keepalive pings of idle connections, 0 to disable")
+var grpcKeepaliveTimeout = flag.Duration("grpc_keepalive_timeout", 20*time.Second, "Timeout of keepalive ping acknowledgement")
+var grpcCompressor = flag.String("grpc_compressor", "", "gRPC message compressor: gzip or zstd, none if empty")
+
+func init() {
+	encoding.RegisterCompressor(grpcZstdCompressor{})
+}
+
+// grpcZstdCompressor compresses gRPC messages with pooled zstd encoders and decoders, it is independent of
+// -compressed_blobs, which compresses blob data instead of messages.
+type grpcZstdCompressor struct{}
+
+type grpcZstdWriter struct {
+	*zstd.Encoder
+}
+
+func (w grpcZstdWriter) Close() error {
+	err := w.Encoder.Close()
+	zstdEncoders.Put(w.Encoder)
+	return err
+}
+
+type grpcZstdReader struct {
+	d *zstd.Decoder
+}
+
+func (r *grpcZstdReader) Read(p []byte) (int, error) {
+	if r.d == nil {
+		return 0, io.EOF
+	}
+	n, err := r.d.Read(p)
+	if err == io.EOF {
+		// Message is fully read, decoder can be reused
+		zstdDecoders.Put(r.d)
+		r.d = nil
+	}
+	return n, err
+}
+
+func (grpcZstdCompressor) Compress(w io.Writer) (io.WriteCloser, error) {
+	e := zstdEncoders.Get().(*zstd.Encoder)
+	e.Reset(w)
+	return grpcZstdWriter{e}, nil
+}
+
+func (grpcZstdCompressor) Decompress(r io.Reader) (io.Reader, error) {
+	d := zstdDecoders.Get()
+	if err := d.Reset(r); err != nil {
+		zstdDecoders.Put(d)
+		return nil, err
+	}
+	return &grpcZstdReader{d}, nil
+}
+
+func (grpcZstdCompressor) Name() string {
+	return "zstd"
+}
+
+func checkGrpcFlags() {
+	if *connections < 0 {
+		log.Fatalf("Invalid number of connections: %d", *connections)
+	}
+	if *grpcCompressor != "" && *grpcCompressor != "gzip" && *grpcCompressor != "zstd" {
+		log.Fatalf("Unknown gRPC compressor: %s", *grpcCompressor)
+	}
+	if *grpcMaxMsgSize < 0 || *grpcWindowSize < 0 || *grpcConnWindowSize < 0 {
+		log.Fatal("gRPC message and window sizes can not be negative")
+	}
+}
+
+// logGrpcOptions logs the transport settings, so throughput of runs with different settings can be compared.
+func logGrpcOptions() {
+	conns := "per client"
+	if *connections > 0 {
+		conns = humanize.Comma(int64(*connections))
+	}
+	if *transport == "http" {
+		log.Printf("HTTP connections: %s", conns)
+		return
+	}
+	size := func(n int) string {
+		if n == 0 {
+			return "default"
+		}
+		return humanize.IBytes(uint64(n))
+	}
+	compressor := *grpcCompressor
+	if compressor == "" {
+		compressor = "none"
+	}
+	keepaliveTime := "disabled"
+	if *grpcKeepaliveTime > 0 {
+		keepaliveTime = grpcKeepaliveTime.String()
+	}
+	log.Printf("gRPC connections: %s, max message size: %s, window: %s, connection window: %s, keepalive: %s, compressor: %s",
+		conns, size(*grpcMaxMsgSize), size(*grpcWindowSize), size(*grpcConnWindowSize), keepaliveTime, compressor)
+}
+
+// grpcTuningDialOptions returns client options of the gRPC tuning flags.
+func grpcTuningDialOptions() []grpc.DialOption {
+	var opts []grpc.DialOption
+	var callOpts []grpc.CallOption
+	if *grpcMaxMsgSize > 0 {
+		callOpts = append(callOpts, grpc.MaxCallRecvMsgSize(*grpcMaxMsgSize), grpc.MaxCallSendMsgSize(*grpcMaxMsgSize))
+	}
+	if *grpcCompressor != "" {
+		callOpts = append(callOpts, grpc.UseCompressor(*grpcCompressor))
+	}
+	if len(callOpts) > 0 {
+		opts = append(opts, grpc.WithDefaultCallOptions(callOpts...))
+	}
+	if *grpcWindowSize > 0 {
+		opts = append(opts, grpc.WithInitialWindowSize(int32(*grpcWindowSize)))
+	}
+	if *grpcConnWindowSize > 0 {
+		opts = append(opts, grpc.WithInitialConnWindowSize(int32(*grpcConnWindowSize)))
+	}
+	if *grpcKeepaliveTime > 0 {
+		opts = append(opts, grpc.WithKeepaliveParams(keepalive.ClientParameters{
+			Time:                *grpcKeepaliveTime,
+			Timeout:             *grpcKeepaliveTimeout,
+			PermitWithoutStream: true,
+		}))
+	}
+	return opts
+}
+
+// grpcServerOptions returns embedded server options matching the client, so it accepts the same messages and pings.
+func grpcServerOptions() []grpc.ServerOption {
+	var opts []grpc.ServerOption
+	if *grpcMaxMsgSize > 0 {
+		opts = append(opts, grpc.MaxRecvMsgSize(*grpcMaxMsgSize), grpc.MaxSendMsgSize(*grpcMaxMsgSize))
+	}
+	if *grpcWindowSize > 0 {
+		opts = append(opts, grpc.InitialWindowSize(int32(*grpcWindowSize)))
+	}
+	if *grpcConnWindowSize > 0 {
+		opts = append(opts, grpc.InitialConnWindowSize(int32(*grpcConnWindowSize)))
+	}
+	if *grpcKeepaliveTime > 0 {
+		opts = append(opts, grpc.KeepaliveEnforcementPolicy(keepalive.EnforcementPolicy{
+			MinTime:             *grpcKeepaliveTime,
+			PermitWithoutStream: true,
+		}))
+	}
+	return opts
+}
+
+var connMu sync.Mutex
+var conns []*grpc.ClientConn
+var nextConn int
+
+func newConn() *grpc.ClientConn {
+	conn, err := grpc.Dial(*addr, append(grpcDialOptions(), grpcTuningDialOptions()...)...)
+	noError(err)
+	return conn
+}
+
+// dial returns a new connection, or one of -connections shared connections, which are created on first use.
+func dial() *grpc.ClientConn {
+	if *connections == 0 {
+		return newConn()
+	}
+
+	connMu.Lock()
+	defer connMu.Unlock()
+	if len(conns) < *connections {
+		conn := newConn()
+		conns = append(conns, conn)
+		return conn
+	}
+	conn := conns[nextConn%len(conns)]
+	nextConn++
+	return conn
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+import "flag"
+
+var httpUser = flag.String("http_user", "", "User for basic auth, sent as authorization header or gRPC metadata, also required by the embedded server if set")
+var httpPassword = flag.String("http_password", "", "Password for basic auth")
+var httpHead = flag.Bool("http_head", false, "Check with HEAD whether the blob exists before PUT with http transport")
+
+// httpTransport uses bazel-remote HTTP cache protocol: GET, PUT and HEAD of /cas/{sha256} and /ac/{sha256}. With
+// -compressed_blobs downloads are requested with Accept-Encoding: zstd and uploads sent with Content-Encoding: zstd.
+type httpTransport struct {
+	client *http.Client
+	base   string
+}
+
+// Connection pool shared by all clients with -connections
+var sharedHttpTransport *http.Transport
+var sharedHttpTransportOnce sync.Once
+
+func newHttpRoundTripper(base string) *http.Transport {
+	tr := &http.Transport{MaxIdleConnsPerHost: 16}
+	if *connections > 0 {
+		tr.MaxConnsPerHost = *connections
+		tr.MaxIdleConnsPerHost = *connections
+	}
+	if strings.HasPrefix(base, "https://") {
+		tr.TLSClientConfig = clientTlsConfig()
+	}
+	return tr
+}
+
+func newHttpTransport(base string) *httpTransport {
+	// Own connection pool, same as a separate gRPC connection of every client, unless -connections are shared
+	tr := newHttpRoundTripper(base)
+	if *connections > 0 {
+		sharedHttpTransportOnce.Do(func() {
+			sharedHttpTransport = tr
+		})
+		tr = sharedHttpTransport
+	}
+	return &httpTransport{
+		client: &http.Client{Transport: tr},
+		base:   strings.TrimSuffix(base, "/"),
+	}
+}
+
+func (t *httpTransport) newRequest(method string, path string, body io.Reader) *http.Request {
+	req, err := http.NewRequest(method, t.base+path, body)
+	noError(err)
+	if auth := authHeader(); auth != "" {
+		req.Header.Set("Authorization", auth)
+	}
+	return req
+}
+
+// statusError converts unsuccessful HTTP response to an error with gRPC code, so callers can check for not found.
+func statusError(resp *http.Response) error {
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	code := codes.Unknown
+	switch resp.StatusCode {
+	case http.StatusNotFound:
+		code = codes.NotFound
+	case http.StatusUnauthorized, http.StatusForbidden:
+		code = codes.PermissionDenied
+	case http.StatusBadRequest:
+		code = codes.InvalidArgument
+	}
+	return status.Errorf(code, "%s %s: %s %s", resp.Request.Method, resp.Request.URL, resp.Status, strings.TrimSpace(string(msg)))
+}
+
+func (t *httpTransport) Download(size int64, sha256 string) (Latency, error) {
+	var l Latency
+	start := time.Now()
+	req := t.newRequest(http.MethodGet, "/cas/"+sha256, nil)
+	if *compressedBlobs {
+		// Set explicitly, so the response is not decompressed transparently by the http package
+		req.Header.Set("Accept-Encoding", "zstd")
+	}
+	resp, err := t.client.Do(req)
+	l.First = time.Now().Sub(start)
+	if err != nil {
+		return l, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		l.Total = time.Now().Sub(start)
+		return l, statusError(resp)
+	}
+
+	var h hash.Hash
+	counter := &wcounter{out: ioutil.Discard}
+	if *verifyDownloads || *compressedBlobs {
+		h = newHash()
+		counter.out = h
+	}
+	if resp.Header.Get("Content-Encoding") == "zstd" {
+		err = zstdDecompress(counter, resp.Body)
+	} else {
+		_, err = io.Copy(counter, resp.Body)
+	}
+	l.Total = time.Now().Sub(start)
+	if err != nil {
+		return l, err
+	}
+
+	if counter.n != size {
+		return l, &CorruptionError{req.URL.String(), fmt.Sprintf("read %d != expected size %d", counter.n, size)}
+	}
+	if h != nil {
+		if got := hex.EncodeToString(h.Sum(nil)); got != sha256 {
+			return l, &CorruptionError{req.URL.String(), fmt.Sprintf("hash %s != expected %s", got, sha256)}
+		}
+	}
+	return l, nil
+}
+
+// DownloadRange uses Range header, the range is always requested without zstd encoding.
+func (t *httpTransport) DownloadRange(size int64, sha256 string, offset int64, limit int64) ([]byte, Latency, error) {
+	var l Latency
+	start := time.Now()
+	req := t.newRequest(http.MethodGet, "/cas/"+sha256, nil)
+	if limit > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+limit-1))
+	} else {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	resp, err := t.client.Do(req)
+	l.First = time.Now().Sub(start)
+	if err != nil {
+		return nil, l, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusPartialContent && resp.StatusCode != http.StatusOK {
+		l.Total = time.Now().Sub(start)
+		return nil, l, statusError(resp)
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	l.Total = time.Now().Sub(start)
+	if err == nil && resp.StatusCode == http.StatusOK {
+		// Server ignored the range
+		if offset > int64(len(data)) {
+			offset = int64(len(data))
+		}
+		data = data[offset:]
+		if limit > 0 && limit < int64(len(data)) {
+			data = data[:limit]
+		}
+	}
+	return data, l, err
+}
+
+func (t *httpTransport) Upload(open uploadSource, size int64, sha256 string) (Latency, error) {
+	var l Latency
+	start := time.Now()
+	if *httpHead {
+		resp, err := t.client.Do(t.newRequest(http.MethodHead, "/cas/"+sha256, nil))
+		if err != nil {
+			return l, err
+		}
+		_ = resp.Body.Close()
+		if resp.StatusCode == http.StatusOK {
+			l.Total = time.Now().Sub(start)
+			return l, nil
+		}
+		if resp.StatusCode != http.StatusNotFound {
+			return l, statusError(resp)
+		}
+	}
+
+	body, err := openUpload(open)
+	if err != nil {
+		return l, err
+	}
+	// Stops compression if upload fails
+	defer body.Close()
+	// Time from sending the last byte to the response is measured as commit latency
+	counter := &eofTimer{r: body}
+	req := t.newRequest(http.MethodPut, "/cas/"+sha256, counter)
+	if *compressedBlobs {
+		req.Header.Set("Content-Encoding", "zstd")
+	} else {
+		req.ContentLength = size
+	}
+	resp, err := t.client.Do(req)
+	end := time.Now()
+	l.Total = end.Sub(start)
+	if !counter.eof.IsZero() {
+		l.First = end.Sub(counter.eof)
+	}
+	if err != nil {
+		return l, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		return l, statusError(resp)
+	}
+	return l, nil
+}
+
+func (t *httpTransport) GetActionResult(digest *remoteexecution.Digest) (*remoteexecution.ActionResult, error) {
+	resp, err := t.client.Do(t.newRequest(http.MethodGet, "/ac/"+digest.Hash, nil))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, statusError(resp)
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	ar := &remoteexecution.ActionResult{}
+	return ar, proto.Unmarshal(data, ar)
+}
+
+func (t *httpTransport) UpdateActionResult(digest *remoteexecution.Digest, ar *remoteexecution.ActionResult) error {
+	data, err := proto.Marshal(ar)
+	noError(err)
+	resp, err := t.client.Do(t.newRequest(http.MethodPut, "/ac/"+digest.Hash, bytes.NewReader(data)))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		return statusError(resp)
+	}
+	return nil
+}
+
+// eofTimer records when all data was read from r.
+type eofTimer struct {
+	r   io.Reader
+	eof time.Time
+}
+
+func (e *eofTimer) Read(p []byte) (int, error) {
+	n, err := e.r.Read(p)
+	if err == io.EOF && e.eof.IsZero() {
+		e.eof = time.Now()
+	}
+	return n, err
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"fmt"
+	"github.com/dustin/go-humanize"
+	"math/bits"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Histogram of durations with log-linear buckets: values below 64ns have own buckets, and every power of two above
+// is split into 32 buckets, so recorded values are accurate to ~3%.
+type Histogram struct {
+	counts [1920]int64
+	count  int64
+	max    time.Duration
+}
+
+func histogramIndex(v uint64) int {
+	if v < 64 {
+		return int(v)
+	}
+	shift := bits.Len64(v) - 6
+	return 64 + (shift-1)*32 + int(v>>uint(shift)) - 32
+}
+
+// histogramValue returns the highest value which falls into bucket i.
+func histogramValue(i int) uint64 {
+	if i < 64 {
+		return uint64(i)
+	}
+	shift := uint((i-64)/32 + 1)
+	return uint64((i-64)%32+32)<<shift + 1<<shift - 1
+}
+
+func (h *Histogram) Record(d time.Duration) {
+	if d < 0 {
+		d = 0
+	}
+	h.counts[histogramIndex(uint64(d))]++
+	h.count++
+	if d > h.max {
+		h.max = d
+	}
+}
+
+func (h *Histogram) Merge(o *Histogram) {
+	for i, c := range o.counts {
+		h.counts[i] += c
+	}
+	h.count += o.count
+	if o.max > h.max {
+		h.max = o.max
+	}
+}
+
+func (h *Histogram) Count() int64 {
+	return h.count
+}
+
+func (h *Histogram) Max() time.Duration {
+	return h.max
+}
+
+// Percentile returns the value below which q (0..1) of the recorded values fall.
+func (h *Histogram) Percentile(q float64) time.Duration {
+	if h.count == 0 {
+		return 0
+	}
+	target := int64(q*float64(h.count) + 0.5)
+	if target < 1 {
+		target = 1
+	}
+	var seen int64
+	for i, c := range h.counts {
+		seen += c
+		if seen >= target {
+			v := time.Duration(histogramValue(i))
+			if v > h.max {
+				return h.max
+			}
+			return v
+		}
+	}
+	return h.max
+}
+
+// Latency of a single request. First is time to first byte for downloads, and time from sending the last
+// data to receiving the response (server commit) for uploads. Queue is time the request waited since it was
+// scheduled in open-loop mode.
+type Latency struct {
+	First time.Duration
+	Total time.Duration
+	Queue time.Duration
+}
+
+// Upper bounds of size buckets for which latencies are reported separately
+var sizeBuckets = []int64{4 << 10, 64 << 10, 1 << 20, 16 << 20, 256 << 20}
+
+func sizeBucket(size int64) int {
+	return sort.Search(len(sizeBuckets), func(i int) bool { return size <= sizeBuckets[i] })
+}
+
+func sizeBucketName(b int) string {
+	if b == len(sizeBuckets) {
+		return ">" + humanize.IBytes(uint64(sizeBuckets[b-1]))
+	}
+	return "<=" + humanize.IBytes(uint64(sizeBuckets[b]))
+}
+
+type latencyKey struct {
+	op     string
+	bucket int
+}
+
+type LatencyStats struct {
+	First Histogram
+	Total Histogram
+	// Only recorded in open-loop mode, corrected for coordinated omission by including queueing
+	Queue     Histogram
+	Corrected Histogram
+}
+
+func (s *LatencyStats) Merge(o *LatencyStats) {
+	s.First.Merge(&o.First)
+	s.Total.Merge(&o.Total)
+	s.Queue.Merge(&o.Queue)
+	s.Corrected.Merge(&o.Corrected)
+}
+
+var latencies = struct {
+	sync.Mutex
+	m map[latencyKey]*LatencyStats
+}{m: make(map[latencyKey]*LatencyStats)}
+
+func recordLatency(op string, size int64, l Latency) {
+	recordInterval(op, size, l)
+	latencies.Lock()
+	defer latencies.Unlock()
+	key := latencyKey{op, sizeBucket(size)}
+	s, ok := latencies.m[key]
+	if !ok {
+		s = &LatencyStats{}
+		latencies.m[key] = s
+	}
+	s.First.Record(l.First)
+	s.Total.Record(l.Total)
+	if openLoop() {
+		s.Queue.Record(l.Queue)
+		s.Corrected.Record(l.Queue + l.Total)
+	}
+}
+
+func printHistogramRow(op string, bucket string, metric string, h *Histogram) {
+	if h.Count() == 0 {
+		return
+	}
+	fmt.Printf("%-12s %12s %9s %8d %10s %10s %10s %10s %10s\n",
+		op, bucket, metric, h.Count(),
+		h.Percentile(0.5).Round(time.Microsecond),
+		h.Percentile(0.9).Round(time.Microsecond),
+		h.Percentile(0.99).Round(time.Microsecond),
+		h.Percentile(0.999).Round(time.Microsecond),
+		h.Max().Round(time.Microsecond))
+}
+
+// printLatencies prints latency percentiles for every operation, per size bucket and for all sizes.
+func printLatencies() {
+	latencies.Lock()
+	defer latencies.Unlock()
+	if len(latencies.m) == 0 {
+		return
+	}
+
+	var keys []latencyKey
+	for k := range latencies.m {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].op != keys[j].op {
+			return keys[i].op < keys[j].op
+		}
+		return keys[i].bucket < keys[j].bucket
+	})
+
+	firstName := map[string]string{"DOWNLOAD": "ttfb", "UPLOAD": "commit", "MISS": "ttfb", "RANGE": "ttfb",
+		"NOT_FOUND": "ttfb", "FILL": "commit", "EVICT_READ": "ttfb"}
+	printStats := func(op string, bucket string, s *LatencyStats) {
+		if name, ok := firstName[op]; ok {
+			printHistogramRow(op, bucket, name, &s.First)
+		}
+		printHistogramRow(op, bucket, "total", &s.Total)
+		printHistogramRow(op, bucket, "queue", &s.Queue)
+		printHistogramRow(op, bucket, "corrected", &s.Corrected)
+	}
+	fmt.Printf("%-12s %12s %9s %8s %10s %10s %10s %10s %10s\n",
+		"op", "size", "metric", "count", "p50", "p90", "p99", "p999", "max")
+	for i, k := range keys {
+		printStats(k.op, sizeBucketName(k.bucket), latencies.m[k])
+
+		if i+1 == len(keys) || keys[i+1].op != k.op {
+			var all LatencyStats
+			for _, k2 := range keys {
+				if k2.op == k.op {
+					all.Merge(latencies.m[k2])
+				}
+			}
+			printStats(k.op, "all", &all)
+		}
+	}
+}
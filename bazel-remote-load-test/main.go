@@ -2,60 +2,70 @@ package main
 
 import (
 	"bytes"
-	"crypto/sha256"
-	"encoding"
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
 	"encoding/hex"
 	"fmt"
 	"github.com/dustin/go-humanize"
-	"google.golang.org/genproto/googleapis/bytestream"
-	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	"io"
 	"log"
 	"math/rand"
 	"os"
 	"path/filepath"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 import "flag"
 
-var addr = flag.String("addr", "", "GRPC address of the ByteStream service")
+var addr = flag.String("addr", "", "GRPC address of the ByteStream service, base URL for http transport, \"embedded\" to start in-process server")
 var rootDir = flag.String("dir", ".", "Root directory to scan for files")
 var iterations = flag.Int("download_iterations", 0, "Number of times to download each file")
 var uploadIterations = flag.Int("upload_iterations", 0, "Number of times to upload each file")
-var parallel = flag.Int("parallel", 2, "Number of parallel downloads/uploads to perform")
+var parallel = flag.Int("parallel", 2, "Number of parallel downloads/uploads to perform, number of clients in open-loop mode")
 
 type FileData struct {
 	Path   string
 	Size   int64
-	Sha256 string
+	Hash   string // hash of -digest_function, which is sha256 by default
 
-	MarshalledHash []byte
+	HashState hashState
+	// Hash state every hashCheckpointInterval bytes, only saved for -upload_mutation=mutate
+	Checkpoints []hashState
 }
 
 type EnhancedFileData struct {
 	File       *FileData
 	ExtraBytes []byte // extra bytes appended to the file
-	ModifiedSha256 string // sha256 of file with appended data
+	ModifiedHash string // hash of file with appended data
+	Mutation *mutation // bytes of the file changed instead of appending data
 }
 
-func getFileSha256(path string) ([]byte, string) {
+func getFileHash(path string) (hashState, []hashState, string) {
 	f, err := os.Open(path)
 	noError(err)
+	defer f.Close()
 
-	h := sha256.New()
-	_, err = io.Copy(h, f)
-	noError(err)
-
-	m, err := h.(encoding.BinaryMarshaler).MarshalBinary()
-	noError(err)
+	h := newHash()
+	var checkpoints []hashState
+	for {
+		if *uploadMutation == "mutate" {
+			checkpoints = append(checkpoints, saveHashState(h))
+		}
+		_, err = io.CopyN(h, f, hashCheckpointInterval)
+		if err == io.EOF {
+			break
+		}
+		noError(err)
+	}
 
-	return m, hex.EncodeToString(h.Sum(nil))
+	return saveHashState(h), checkpoints, hex.EncodeToString(h.Sum(nil))
 }
 
-func extendSha256(marshalledHash []byte, extraBytes []byte) string {
-	h := sha256.New()
-	noError(h.(encoding.BinaryUnmarshaler).UnmarshalBinary(marshalledHash))
+func extendHash(state hashState, extraBytes []byte) string {
+	h := state.resume()
 	_, err := h.Write(extraBytes)
 	noError(err)
 	return hex.EncodeToString(h.Sum(nil))
@@ -69,8 +79,8 @@ func getFiles() []*FileData {
 			return nil
 		}
 		if info.Mode().IsRegular() {
-			h, s := getFileSha256(path)
-			files = append(files, &FileData{Path: path, Size: info.Size(), MarshalledHash: h, Sha256: s})
+			h, checkpoints, s := getFileHash(path)
+			files = append(files, &FileData{Path: path, Size: info.Size(), HashState: h, Checkpoints: checkpoints, Hash: s})
 		}
 		return nil
 	})
@@ -78,135 +88,351 @@ func getFiles() []*FileData {
 	return files
 }
 
-func uploadFiles(client bytestream.ByteStreamClient, files []*FileData) {
+func uploadFiles(client *Client, files []*FileData) {
 	for _, f := range files {
-		err := uploadFile(client, f.Path, f.Size, f.Sha256)
+		err := uploadFile(client, f.Path, f.Size, f.Hash)
 		if err != nil {
 			panic(fmt.Sprintf("Unable to upload %v: %s", f, err))
 		}
 	}
 }
 
-func createClient() bytestream.ByteStreamClient {
-	conn, err := grpc.Dial(*addr, grpc.WithInsecure())
-	noError(err)
-	return bytestream.NewByteStreamClient(conn)
+// Client has transport of blobs and action results, and CAS client for batch calls, which is nil for http transport.
+type Client struct {
+	Transport
+	CAS remoteexecution.ContentAddressableStorageClient
 }
 
-func downloadBenchmark(files []*FileData) {
-	numDownloads := *iterations * len(files)
-	toDownload := make(chan *FileData, numDownloads)
-	downloaded := make(chan *FileData, numDownloads)
-	for i := 0; i < *iterations; i++ {
-		for _, f := range files {
-			toDownload <- f
-		}
+func createClient() *Client {
+	if *transport == "http" {
+		return &Client{Transport: newHttpTransport(*addr)}
+	}
+	conn := dial()
+	return &Client{
+		Transport: newGrpcTransport(conn),
+		CAS:       remoteexecution.NewContentAddressableStorageClient(conn),
 	}
+}
 
-	startDownload := time.Now()
+// Number of downloaded blobs which did not match expected size or hash
+var corruptedDownloads, corruptedUploads int64
+
+// benchmarkRequests returns number of requests of a benchmark, -1 if it runs for -duration.
+func benchmarkRequests(iterations int, count int) int {
+	if *duration > 0 {
+		return -1
+	}
+	return iterations * count
+}
+
+// progress formats number of finished requests for the progress log.
+func progress(i int, n int) string {
+	if n < 0 {
+		return strconv.Itoa(i)
+	}
+	return fmt.Sprintf("%d/%d", i, n)
+}
+
+// runClosedLoop runs requests on -parallel clients, each client starts the next request when the previous finished.
+// do is called for requests 0..n-1, or until -duration elapses if n is negative.
+func runClosedLoop(op string, n int, do func(client *Client, i int)) {
+	start := time.Now()
+	next := int64(-1)
+	var w sync.WaitGroup
 	for i := 0; i < *parallel; i++ {
+		w.Add(1)
 		go func(clientIdx int) {
+			defer w.Done()
 			client := createClient()
-		F:
 			for {
-				select {
-				case f := <-toDownload:
-					noError(downloadFile(client, f.Size, f.Sha256))
-					downloaded <- f
-
-				default:
-					break F
+				i := int(atomic.AddInt64(&next, 1))
+				if n >= 0 && i >= n || n < 0 && time.Now().Sub(start) >= *duration {
+					break
 				}
+				do(client, i)
+			}
+			if *reportInterval == 0 {
+				log.Printf("%-9s Client %d finished", op, clientIdx)
 			}
-			log.Printf("DOWNLOAD  Client %d finished", clientIdx)
 		}(i)
 	}
+	w.Wait()
+}
+
+// downloadResult is size and op of a finished download, ranged reads, misses and blobs not found are reported
+// separately.
+type downloadResult struct {
+	size int64
+	op   string
+}
+
+func downloadBenchmark(files []*FileData) {
+	numDownloads := benchmarkRequests(*iterations, len(files))
+	downloaded := make(chan downloadResult, *parallel)
+	// Random sources of missing digests, reused by workers instead of seeding one for every miss
+	missRands := sync.Pool{New: func() interface{} { return rand.New(rand.NewSource(rand.Int63())) }}
+	download := func(client *Client, f *FileData, queue time.Duration) {
+		if *missRate > 0 && rand.Float64() < *missRate {
+			r := missRands.Get().(*rand.Rand)
+			downloadMissing(client, r, f.Size, queue)
+			missRands.Put(r)
+			downloaded <- downloadResult{0, "MISS"}
+			return
+		}
+
+		if f.Size > 0 && rand.Float64() < *rangedReads {
+			size, l, err := readRange(client, f)
+			l.Queue = queue
+			if status.Code(err) == codes.NotFound {
+				atomic.AddInt64(&downloadNotFound, 1)
+				recordLatency("NOT_FOUND", f.Size, l)
+				downloaded <- downloadResult{0, "NOT_FOUND"}
+				return
+			}
+			atomic.AddInt64(&downloadHits, 1)
+			recordLatency("RANGE", size, l)
+			downloaded <- downloadResult{size, "RANGE"}
+			return
+		}
+
+		l, err := client.Download(f.Size, f.Hash)
+		l.Queue = queue
+		if status.Code(err) == codes.NotFound {
+			atomic.AddInt64(&downloadNotFound, 1)
+			recordLatency("NOT_FOUND", f.Size, l)
+			downloaded <- downloadResult{0, "NOT_FOUND"}
+			return
+		}
+		atomic.AddInt64(&downloadHits, 1)
+		recordLatency("DOWNLOAD", f.Size, l)
+		if isCorruption(err) {
+			atomic.AddInt64(&corruptedDownloads, 1)
+			recordError("DOWNLOAD")
+			log.Printf("DOWNLOAD  %s", err)
+		} else {
+			noError(err)
+		}
+		downloaded <- downloadResult{f.Size, "DOWNLOAD"}
+	}
+	get := func(i int) *FileData { return files[i%len(files)] }
 
-	var downloadedSize uint64
-	for i := 0; i < numDownloads; i++ {
-		f := <-downloaded
-		downloadedSize += uint64(f.Size)
-		speed := uint64(float64(downloadedSize) / time.Now().Sub(startDownload).Seconds())
-		log.Printf("DOWNLOAD  [%d/%d] downloaded size: %s  avg throughput: %s/s",
-			i+1, numDownloads, humanize.Bytes(downloadedSize), humanize.Bytes(speed))
+	startDownload := time.Now()
+	go func() {
+		if openLoop() {
+			runOpenLoop("DOWNLOAD", numDownloads, func(i int) int64 { return get(i).Size },
+				func(client *Client, i int, queue time.Duration) { download(client, get(i), queue) })
+		} else {
+			runClosedLoop("DOWNLOAD", numDownloads, func(client *Client, i int) { download(client, get(i), 0) })
+		}
+		close(downloaded)
+	}()
+
+	var downloadedSize, rangedSize uint64
+	count, rangedCount, total := 0, 0, 0
+	for r := range downloaded {
+		total++
+		switch r.op {
+		case "RANGE":
+			rangedCount++
+			rangedSize += uint64(r.size)
+		case "DOWNLOAD":
+			count++
+			downloadedSize += uint64(r.size)
+		}
+		if *reportInterval == 0 {
+			speed := uint64(float64(downloadedSize) / time.Now().Sub(startDownload).Seconds())
+			log.Printf("DOWNLOAD  [%s] downloaded size: %s  avg throughput: %s/s",
+				progress(total, numDownloads), humanize.Bytes(downloadedSize), humanize.Bytes(speed))
+		}
+	}
+	elapsed := time.Now().Sub(startDownload)
+	log.Printf("DOWNLOAD  finished %d downloads in %s, size: %s  avg throughput: %s/s", count, elapsed.Round(time.Millisecond),
+		humanize.Bytes(downloadedSize), humanize.Bytes(uint64(float64(downloadedSize)/elapsed.Seconds())))
+	if corrupted := atomic.LoadInt64(&corruptedDownloads); *verifyDownloads || *compressedBlobs || corrupted > 0 {
+		log.Printf("DOWNLOAD  corrupted: %d of %d", corrupted, count)
 	}
+	if rangedCount > 0 {
+		log.Printf("RANGE     finished %d ranged reads, size: %s  avg throughput: %s/s  corrupted: %d", rangedCount,
+			humanize.Bytes(rangedSize), humanize.Bytes(uint64(float64(rangedSize)/elapsed.Seconds())), atomic.LoadInt64(&corruptedRanges))
+	}
+	logDownloadHits()
+}
+
+// uploadSize returns size of a unique upload of the file.
+func uploadSize(f *FileData) int64 {
+	if *uploadMutation == "mutate" && f.Size > 0 {
+		return f.Size
+	}
+	return f.Size + 16
 }
 
 func uploadBenchmark(files []*FileData) {
-	numUploads := *uploadIterations * len(files)
-	toUpload := make(chan *EnhancedFileData, numUploads)
-	uploaded := make(chan *EnhancedFileData, numUploads)
+	numUploads := benchmarkRequests(*uploadIterations, len(files))
+	uploaded := make(chan *EnhancedFileData, *parallel)
+	// Uploads cancelled by -cancel_uploads, which are not counted as finished
+	var cancelled int64
+	upload := func(client *Client, i int, queue time.Duration) {
+		f := &EnhancedFileData{File: files[i%len(files)]}
+		if *uploadMutation == "mutate" && f.File.Size > 0 {
+			f.Mutation = newMutation(f.File.Size)
+			f.ModifiedHash = mutatedHash(f.File, f.Mutation)
+		} else {
+			f.ExtraBytes = make([]byte, 16)
+			_, err := rand.Read(f.ExtraBytes)
+			noError(err)
+			f.ModifiedHash = extendHash(f.File.HashState, f.ExtraBytes)
+		}
 
-	for i := 0; i < *uploadIterations; i++ {
-		extraBytes := make([]byte, 16)
-		_, err := rand.Read(extraBytes)
+		open := func() (io.ReadCloser, error) {
+			r, err := os.Open(f.File.Path)
+			if err != nil {
+				return nil, err
+			}
+			if f.Mutation != nil {
+				return readCloser{newMutatingReader(r, 0, f.Mutation), r}, nil
+			}
+			return readCloser{io.MultiReader(r, bytes.NewReader(f.ExtraBytes)), r}, nil
+		}
+		size := f.File.Size + int64(len(f.ExtraBytes))
+		l, err := client.Upload(open, size, f.ModifiedHash)
+		if err == errUploadCancelled {
+			atomic.AddInt64(&cancelled, 1)
+			return
+		}
 		noError(err)
-		for _, f := range files {
-			e := &EnhancedFileData{
-				File:           f,
-				ExtraBytes:     extraBytes,
-				ModifiedSha256: extendSha256(f.MarshalledHash, extraBytes),
+		l.Queue = queue
+		recordLatency("UPLOAD", size, l)
+		if *verifyDownloads {
+			_, err := client.Download(size, f.ModifiedHash)
+			if isCorruption(err) {
+				atomic.AddInt64(&corruptedUploads, 1)
+				recordError("UPLOAD")
+				log.Printf("UPLOAD    %s", err)
+			} else {
+				noError(err)
 			}
-			toUpload <- e
 		}
+		uploaded <- f
 	}
 
 	startUpload := time.Now()
-	for i := 0; i < *parallel; i++ {
-		go func(clientIdx int) {
-			client := createClient()
-		F:
-			for {
-				select {
-				case f := <-toUpload:
-					r, err := os.Open(f.File.Path)
-					noError(err)
-					mr := io.MultiReader(r, bytes.NewReader(f.ExtraBytes))
-					noError(uploadFromReader(client, mr, f.File.Size+int64(len(f.ExtraBytes)), f.ModifiedSha256))
-					uploaded <- f
-					noError(r.Close())
-				default:
-					break F
-				}
-			}
-			log.Printf("UPLOAD    Client %d finished", clientIdx)
-		}(i)
-	}
+	go func() {
+		if openLoop() {
+			runOpenLoop("UPLOAD", numUploads, func(i int) int64 { return uploadSize(files[i%len(files)]) }, upload)
+		} else {
+			runClosedLoop("UPLOAD", numUploads, func(client *Client, i int) { upload(client, i, 0) })
+		}
+		close(uploaded)
+	}()
 
 	var uploadedSize uint64
-	for i := 0; i < numUploads; i++ {
-		f := <-uploaded
+	count := 0
+	for f := range uploaded {
+		count++
 		uploadedSize += uint64(f.File.Size + int64(len(f.ExtraBytes)))
-		speed := uint64(float64(uploadedSize) / time.Now().Sub(startUpload).Seconds())
-		log.Printf("UPLOAD   [%d/%d] uploaded size: %s  avg throughput: %s/s",
-			i+1, numUploads, humanize.Bytes(uploadedSize), humanize.Bytes(speed))
+		if *reportInterval == 0 {
+			speed := uint64(float64(uploadedSize) / time.Now().Sub(startUpload).Seconds())
+			log.Printf("UPLOAD   [%s] uploaded size: %s  avg throughput: %s/s",
+				progress(count, numUploads), humanize.Bytes(uploadedSize), humanize.Bytes(speed))
+		}
+	}
+	elapsed := time.Now().Sub(startUpload)
+	log.Printf("UPLOAD    finished %d uploads in %s, size: %s  avg throughput: %s/s  cancelled: %d", count,
+		elapsed.Round(time.Millisecond), humanize.Bytes(uploadedSize), humanize.Bytes(uint64(float64(uploadedSize)/elapsed.Seconds())),
+		atomic.LoadInt64(&cancelled))
+	if *verifyDownloads {
+		log.Printf("UPLOAD    corrupted: %d of %d", atomic.LoadInt64(&corruptedUploads), count)
 	}
+	logUploadMessages()
+	logMutations()
+	logUploadFaults()
 }
 
 func main() {
 	flag.Parse()
-	if *uploadIterations == 0 && *iterations == 0 {
-		log.Fatal("Need to specify at least one of -upload_iterations or -download_iterations")
+	if *uploadIterations == 0 && *iterations == 0 && *casIterations == 0 && *acIterations == 0 && *workloadProfile == "" && *evictFill == "" {
+		log.Fatal("Need to specify at least one of -upload_iterations, -download_iterations, -cas_iterations, -ac_iterations, -workload or -evict_fill")
 	}
+	checkZstdImpl()
+	checkDigestFunction()
+	checkTransport()
+	checkTlsFlags()
+	checkGrpcFlags()
+	checkUploadFaults()
+	checkUploadChunkSize()
+	checkMutationFlags()
+	checkRangeFlags()
+	checkRateFlags()
+	checkWorkloadFlags()
+	checkCacheScenarioFlags()
+	checkServerMonitorFlags()
+	checkMetricsFlags()
 
 	rand.Seed(time.Now().UTC().UnixNano())
 
+	if *addr == embeddedAddr {
+		grpcAddr, httpAddr := startEmbeddedServer()
+		*addr = grpcAddr
+		httpUrl := "http://" + httpAddr
+		if *useTls {
+			httpUrl = "https://" + httpAddr
+		}
+		if *transport == "http" {
+			*addr = httpUrl
+		}
+		if *metricsUrl == embeddedAddr {
+			*metricsUrl = httpUrl + "/metrics"
+		}
+	}
+
 	root, err := filepath.Abs(*rootDir)
 	if err != nil {
 		panic(err)
 	}
 	log.Printf("Scanning files in: %s\n", root)
 
+	logGrpcOptions()
 	files := getFiles()
 	if len(files) == 0 {
 		fmt.Printf("No files found")
 		return
 	}
 
-	start := time.Now()
-	uploadFiles(createClient(), files)
-	log.Printf("Uploaded base files in %s", time.Now().Sub(start))
+	if *coldCache {
+		log.Printf("Cold cache, base files are not uploaded")
+	} else {
+		start := time.Now()
+		cpu := getClientCpu()
+		uploadFiles(createClient(), files)
+		log.Printf("Uploaded base files in %s", time.Now().Sub(start))
+		logClientCpu("base upload", cpu)
+	}
+	// Only messages and faults of benchmarks are reported
+	atomic.StoreInt64(&uploadMessages, 0)
+	for _, c := range []*int64{&interruptedUploads, &resumedUploads, &restartedUploads, &cancelledUploads, &unsupportedQueries} {
+		atomic.StoreInt64(c, 0)
+	}
 
+	stopReporter := startReporter()
+	stopServerMonitor := startServerMonitor()
+	stopMetricsScraper := startMetricsScraper()
+	if *evictFill != "" {
+		cpu := getClientCpu()
+		evictionBenchmark(files)
+		logClientCpu("eviction", cpu)
+	}
+	if *workloadProfile != "" {
+		cpu := getClientCpu()
+		runWorkload(files)
+		logClientCpu("workload", cpu)
+		stopReporter()
+		stopServerMonitor()
+		stopMetricsScraper()
+		printLatencies()
+		return
+	}
+
+	cpu := getClientCpu()
 	var w sync.WaitGroup
 	if *iterations > 0 {
 		w.Add(1)
@@ -222,7 +448,30 @@ func main() {
 			w.Done()
 		}()
 	}
+	if *casIterations > 0 {
+		w.Add(1)
+		go func() {
+			casBenchmark(files)
+			w.Done()
+		}()
+	}
+	if *acIterations > 0 {
+		w.Add(1)
+		go func() {
+			acBenchmark(files)
+			w.Done()
+		}()
+	}
 	w.Wait()
+	if *iterations > 0 || *uploadIterations > 0 || *casIterations > 0 || *acIterations > 0 {
+		logClientCpu("benchmarks", cpu)
+	}
+	stopReporter()
+	stopServerMonitor()
+	stopMetricsScraper()
+	closeZstdDecoders()
+
+	printLatencies()
 }
 
 func noError(err error) {
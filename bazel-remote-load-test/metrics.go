@@ -0,0 +1,345 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+import "flag"
+
+var metricsUrl = flag.String("metrics_url", "", "Prometheus metrics URL of the server to scrape before and after the run, \"embedded\" for the embedded server")
+var metricsNames = flag.String("metrics", "", "Comma separated prefixes of names of counters and histograms to report deltas of, all if empty")
+var metricsInterval = flag.Duration("metrics_interval", 0, "Interval of scrapes during the run, reporting rates of counters, 0 to scrape only before and after")
+
+func checkMetricsFlags() {
+	if *metricsUrl == embeddedAddr && *addr != embeddedAddr {
+		log.Fatal("-metrics_url=embedded needs -addr=embedded")
+	}
+	if *metricsInterval < 0 {
+		log.Fatalf("Invalid metrics interval: %s", *metricsInterval)
+	}
+}
+
+// metricsSample is a scrape of metrics in Prometheus text format: value of every series by name and labels, e.g.
+// `requests_total{method="GET"}`, and type of every metric family.
+type metricsSample struct {
+	time   time.Time
+	values map[string]float64
+	types  map[string]string
+}
+
+// label is a label of a series, with its text as exposed, e.g. `path="a\"b"`, so series are reported unchanged.
+type label struct {
+	name  string
+	value string
+	raw   string
+}
+
+// parseSeries splits a series into metric name and labels, which may contain escaped quotes and commas in values.
+func parseSeries(series string) (string, []label, error) {
+	i := strings.IndexByte(series, '{')
+	if i < 0 {
+		return series, nil, nil
+	}
+	name := series[:i]
+	var labels []label
+	s := series[i+1:]
+	for {
+		s = strings.TrimLeft(s, ", ")
+		if strings.HasPrefix(s, "}") {
+			return name, labels, nil
+		}
+		rest := s
+		eq := strings.Index(s, "=\"")
+		if eq < 0 {
+			return "", nil, fmt.Errorf("invalid labels: %s", series)
+		}
+		key := strings.TrimSpace(s[:eq])
+		s = s[eq+2:]
+		var value strings.Builder
+		for {
+			if s == "" {
+				return "", nil, fmt.Errorf("unterminated label value: %s", series)
+			}
+			if s[0] == '\\' && len(s) > 1 {
+				switch s[1] {
+				case 'n':
+					value.WriteByte('\n')
+				default:
+					value.WriteByte(s[1])
+				}
+				s = s[2:]
+				continue
+			}
+			if s[0] == '"' {
+				s = s[1:]
+				break
+			}
+			value.WriteByte(s[0])
+			s = s[1:]
+		}
+		labels = append(labels, label{name: key, value: value.String(), raw: rest[:len(rest)-len(s)]})
+	}
+}
+
+// joinSeries returns series of the name with raw text of the labels, without the excluded label.
+func joinSeries(name string, labels []label, exclude string) string {
+	var parts []string
+	for _, l := range labels {
+		if l.name != exclude {
+			parts = append(parts, l.raw)
+		}
+	}
+	if len(parts) == 0 {
+		return name
+	}
+	return name + "{" + strings.Join(parts, ",") + "}"
+}
+
+func parseMetrics(r io.Reader) (*metricsSample, error) {
+	m := &metricsSample{time: time.Now(), values: make(map[string]float64), types: make(map[string]string)}
+	s := bufio.NewScanner(r)
+	s.Buffer(nil, 1<<20)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if strings.HasPrefix(line, "# TYPE ") {
+			if f := strings.Fields(line); len(f) == 4 {
+				m.types[f[2]] = f[3]
+			}
+			continue
+		}
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		// Value is after the labels, optionally followed by a timestamp
+		end := strings.LastIndexByte(line, '}') + 1
+		if end == 0 {
+			end = strings.IndexByte(line, ' ')
+		}
+		if end <= 0 {
+			return nil, fmt.Errorf("invalid metrics line: %s", line)
+		}
+		f := strings.Fields(line[end:])
+		if len(f) == 0 {
+			return nil, fmt.Errorf("invalid metrics line: %s", line)
+		}
+		v, err := strconv.ParseFloat(f[0], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid metrics value: %s", line)
+		}
+		name, labels, err := parseSeries(line[:end])
+		if err != nil {
+			return nil, err
+		}
+		m.values[joinSeries(name, labels, "")] = v
+	}
+	return m, s.Err()
+}
+
+func scrapeMetrics(url string) (*metricsSample, error) {
+	client := &http.Client{Timeout: 10 * time.Second}
+	if strings.HasPrefix(url, "https://") {
+		client.Transport = &http.Transport{TLSClientConfig: clientTlsConfig()}
+	}
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("scraping %s: %s", url, resp.Status)
+	}
+	return parseMetrics(resp.Body)
+}
+
+// selectedMetric returns whether the metric family is reported, it is matched by -metrics prefixes.
+func selectedMetric(name string) bool {
+	if *metricsNames == "" {
+		return true
+	}
+	for _, prefix := range strings.Split(*metricsNames, ",") {
+		if strings.HasPrefix(name, strings.TrimSpace(prefix)) {
+			return true
+		}
+	}
+	return false
+}
+
+// histogramDelta is the change of a histogram series between two scrapes.
+type histogramDelta struct {
+	count float64
+	sum   float64
+	// Cumulative counts by upper bound
+	buckets map[float64]float64
+}
+
+// quantile estimates a quantile by linear interpolation within the bucket, same as Prometheus histogram_quantile.
+func (h *histogramDelta) quantile(q float64) float64 {
+	var bounds []float64
+	for b := range h.buckets {
+		bounds = append(bounds, b)
+	}
+	sort.Float64s(bounds)
+	if len(bounds) == 0 || h.count == 0 {
+		return math.NaN()
+	}
+	rank := q * h.buckets[bounds[len(bounds)-1]]
+	lower, lowerCount := 0.0, 0.0
+	for _, b := range bounds {
+		count := h.buckets[b]
+		if count >= rank {
+			if math.IsInf(b, 1) {
+				return lower
+			}
+			if count == lowerCount {
+				return b
+			}
+			return lower + (b-lower)*(rank-lowerCount)/(count-lowerCount)
+		}
+		lower, lowerCount = b, count
+	}
+	return lower
+}
+
+// metricsDeltas returns changes of selected counters, and of selected histograms by series without the le label.
+func metricsDeltas(before *metricsSample, after *metricsSample) (map[string]float64, map[string]*histogramDelta) {
+	counters := make(map[string]float64)
+	histograms := make(map[string]*histogramDelta)
+	for series, v := range after.values {
+		name, labels, err := parseSeries(series)
+		noError(err)
+		delta := v - before.values[series]
+		if t := after.types[name]; t == "counter" && selectedMetric(name) {
+			counters[series] = delta
+			continue
+		}
+
+		for _, suffix := range []string{"_bucket", "_sum", "_count"} {
+			family := strings.TrimSuffix(name, suffix)
+			if family == name || after.types[family] != "histogram" || !selectedMetric(family) {
+				continue
+			}
+			key := joinSeries(family, labels, "le")
+			h, ok := histograms[key]
+			if !ok {
+				h = &histogramDelta{buckets: make(map[float64]float64)}
+				histograms[key] = h
+			}
+			switch suffix {
+			case "_bucket":
+				for _, l := range labels {
+					if le, err := strconv.ParseFloat(l.value, 64); l.name == "le" && err == nil {
+						h.buckets[le] = delta
+					}
+				}
+			case "_sum":
+				h.sum = delta
+			case "_count":
+				h.count = delta
+			}
+		}
+	}
+	return counters, histograms
+}
+
+func sortedKeys(m interface{}) []string {
+	var keys []string
+	switch m := m.(type) {
+	case map[string]float64:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	case map[string]*histogramDelta:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// formatMetric formats a value without exponent, unless it is small, e.g. a latency in seconds.
+func formatMetric(v float64) string {
+	if math.Abs(v) >= 1000 || v == math.Trunc(v) {
+		return strconv.FormatFloat(v, 'f', 0, 64)
+	}
+	return strconv.FormatFloat(v, 'g', 4, 64)
+}
+
+func logMetricsDeltas(before *metricsSample, after *metricsSample) {
+	seconds := after.time.Sub(before.time).Seconds()
+	counters, histograms := metricsDeltas(before, after)
+	for _, series := range sortedKeys(counters) {
+		log.Printf("METRICS   %s  delta: %s  rate: %.1f/s", series, formatMetric(counters[series]), counters[series]/seconds)
+	}
+	for _, series := range sortedKeys(histograms) {
+		h := histograms[series]
+		if h.count == 0 {
+			continue
+		}
+		log.Printf("METRICS   %s  count: %s  avg: %s  p50: %s  p90: %s  p99: %s", series, formatMetric(h.count),
+			formatMetric(h.sum/h.count), formatMetric(h.quantile(0.5)), formatMetric(h.quantile(0.9)), formatMetric(h.quantile(0.99)))
+	}
+}
+
+// startMetricsScraper scrapes -metrics_url, and every -metrics_interval logs rates of changed counters since the
+// previous scrape. Returned function scrapes the metrics once more, and logs deltas of counters and histograms of the
+// whole run.
+func startMetricsScraper() func() {
+	if *metricsUrl == "" {
+		return func() {}
+	}
+
+	first, err := scrapeMetrics(*metricsUrl)
+	noError(err)
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if *metricsInterval <= 0 {
+			<-stop
+			return
+		}
+		ticker := time.NewTicker(*metricsInterval)
+		defer ticker.Stop()
+		last := first
+		for {
+			select {
+			case <-ticker.C:
+			case <-stop:
+				return
+			}
+			m, err := scrapeMetrics(*metricsUrl)
+			if err != nil {
+				log.Printf("METRICS   %s", err)
+				continue
+			}
+			seconds := m.time.Sub(last.time).Seconds()
+			counters, _ := metricsDeltas(last, m)
+			for _, series := range sortedKeys(counters) {
+				if counters[series] != 0 {
+					log.Printf("METRICS   %6.1fs  %s  rate: %.1f/s", m.time.Sub(first.time).Seconds(), series, counters[series]/seconds)
+				}
+			}
+			last = m
+		}
+	}()
+
+	return func() {
+		close(stop)
+		<-done
+		last, err := scrapeMetrics(*metricsUrl)
+		if err != nil {
+			log.Printf("METRICS   %s", err)
+			return
+		}
+		logMetricsDeltas(first, last)
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"math"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseSeries(t *testing.T) {
+	for _, tc := range []struct {
+		series string
+		name   string
+		labels []label
+	}{
+		{series: "up", name: "up"},
+		{series: "up{}", name: "up"},
+		{series: `requests_total{method="GET",code="200"}`, name: "requests_total", labels: []label{
+			{name: "method", value: "GET", raw: `method="GET"`},
+			{name: "code", value: "200", raw: `code="200"`},
+		}},
+		{series: `weird_total{path="a\"b,c\\d\ne", x=""}`, name: "weird_total", labels: []label{
+			{name: "path", value: "a\"b,c\\d\ne", raw: `path="a\"b,c\\d\ne"`},
+			{name: "x", value: "", raw: `x=""`},
+		}},
+		{series: `trailing_comma{a="1",}`, name: "trailing_comma", labels: []label{{name: "a", value: "1", raw: `a="1"`}}},
+	} {
+		name, labels, err := parseSeries(tc.series)
+		if err != nil {
+			t.Errorf("%s: %s", tc.series, err)
+			continue
+		}
+		if name != tc.name || !reflect.DeepEqual(labels, tc.labels) {
+			t.Errorf("%s: got %s %+v, want %s %+v", tc.series, name, labels, tc.name, tc.labels)
+		}
+	}
+
+	for _, series := range []string{`bad{a}`, `bad{a="1`, `bad{a="1\"}`} {
+		if _, _, err := parseSeries(series); err == nil {
+			t.Errorf("%s: expected error", series)
+		}
+	}
+}
+
+func TestParseMetrics(t *testing.T) {
+	text := `# HELP bazel_remote_disk_cache_hits The total number of disk backend cache hits
+# TYPE bazel_remote_disk_cache_hits counter
+bazel_remote_disk_cache_hits 12
+# TYPE grpc_server_handled_total counter
+grpc_server_handled_total{grpc_code="OK",grpc_method="Read"} 3 1700000000000
+# TYPE request_seconds histogram
+request_seconds_bucket{path="a\"b",le="0.5"} 1
+request_seconds_bucket{path="a\"b",le="+Inf"} 2
+request_seconds_sum{path="a\"b"} 1.5
+request_seconds_count{path="a\"b"} 2
+# TYPE go_gc_duration_seconds summary
+go_gc_duration_seconds{quantile="0.5"} NaN
+`
+	m, err := parseMetrics(strings.NewReader(text))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for series, want := range map[string]float64{
+		"bazel_remote_disk_cache_hits":                                 12,
+		`grpc_server_handled_total{grpc_code="OK",grpc_method="Read"}`: 3,
+		`request_seconds_bucket{path="a\"b",le="+Inf"}`:                2,
+		`request_seconds_sum{path="a\"b"}`:                             1.5,
+	} {
+		if got, ok := m.values[series]; !ok || got != want {
+			t.Errorf("%s: got %g, want %g", series, got, want)
+		}
+	}
+	if v := m.values[`go_gc_duration_seconds{quantile="0.5"}`]; !math.IsNaN(v) {
+		t.Errorf("expected NaN, got %g", v)
+	}
+	if m.types["request_seconds"] != "histogram" || m.types["bazel_remote_disk_cache_hits"] != "counter" {
+		t.Errorf("unexpected types: %v", m.types)
+	}
+
+	if _, err := parseMetrics(strings.NewReader("no_value\n")); err == nil {
+		t.Error("expected error for series without value")
+	}
+	if _, err := parseMetrics(strings.NewReader("bad_value 1x\n")); err == nil {
+		t.Error("expected error for invalid value")
+	}
+}
+
+func TestMetricsDeltas(t *testing.T) {
+	setString(t, metricsNames, "")
+	before, err := parseMetrics(strings.NewReader(`# TYPE hits_total counter
+hits_total{kind="cas"} 10
+# TYPE size_bytes histogram
+size_bytes_bucket{op="get",le="100"} 1
+size_bytes_bucket{op="get",le="200"} 1
+size_bytes_bucket{op="get",le="+Inf"} 1
+size_bytes_sum{op="get"} 50
+size_bytes_count{op="get"} 1
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	after, err := parseMetrics(strings.NewReader(`# TYPE hits_total counter
+hits_total{kind="cas"} 15
+hits_total{kind="ac"} 2
+# TYPE size_bytes histogram
+size_bytes_bucket{op="get",le="100"} 5
+size_bytes_bucket{op="get",le="200"} 9
+size_bytes_bucket{op="get",le="+Inf"} 11
+size_bytes_sum{op="get"} 1850
+size_bytes_count{op="get"} 11
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	counters, histograms := metricsDeltas(before, after)
+	if !reflect.DeepEqual(counters, map[string]float64{`hits_total{kind="cas"}`: 5, `hits_total{kind="ac"}`: 2}) {
+		t.Errorf("unexpected counters: %v", counters)
+	}
+	h, ok := histograms[`size_bytes{op="get"}`]
+	if !ok || len(histograms) != 1 {
+		t.Fatalf("unexpected histograms: %v", histograms)
+	}
+	want := &histogramDelta{count: 10, sum: 1800, buckets: map[float64]float64{100: 4, 200: 8, math.Inf(1): 10}}
+	if !reflect.DeepEqual(h, want) {
+		t.Errorf("got %+v, want %+v", h, want)
+	}
+
+	setString(t, metricsNames, "size_")
+	counters, histograms = metricsDeltas(before, after)
+	if len(counters) != 0 || len(histograms) != 1 {
+		t.Errorf("unexpected metrics selected by prefix: %v %v", counters, histograms)
+	}
+}
+
+func TestHistogramQuantile(t *testing.T) {
+	h := &histogramDelta{count: 10, sum: 1800, buckets: map[float64]float64{100: 4, 200: 8, math.Inf(1): 10}}
+	for _, tc := range []struct{ q, want float64 }{
+		// Interpolated within the first bucket from 0
+		{0.2, 50},
+		// 5th of 10 is the first of 4 in the second bucket
+		{0.5, 125},
+		{0.8, 200},
+		// Above the last finite bucket, its upper bound
+		{0.99, 200},
+	} {
+		if got := h.quantile(tc.q); math.Abs(got-tc.want) > 1e-9 {
+			t.Errorf("quantile %g: got %g, want %g", tc.q, got, tc.want)
+		}
+	}
+	if got := (&histogramDelta{buckets: map[float64]float64{}}).quantile(0.5); !math.IsNaN(got) {
+		t.Errorf("expected NaN of empty histogram, got %g", got)
+	}
+}
+
+func TestEmbeddedMetrics(t *testing.T) {
+	setString(t, metricsNames, "")
+	store := newEmbeddedStore("", "uncompressed", "go", 0)
+	server := httptest.NewServer(&embeddedHttpHandler{store: store})
+	defer server.Close()
+
+	before, err := scrapeMetrics(server.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, hash := testBlob(3000)
+	if err := store.put(hash, data); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, ok, err := store.get(hash); !ok || err != nil {
+			t.Fatalf("get: %t %v", ok, err)
+		}
+	}
+	_, missing := testBlob(3001)
+	if _, ok, _ := store.get(missing); ok {
+		t.Fatal("unexpected blob")
+	}
+	after, err := scrapeMetrics(server.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	counters, histograms := metricsDeltas(before, after)
+	for series, want := range map[string]float64{
+		`embedded_cache_hits_total{kind="cas"}`:   3,
+		`embedded_cache_misses_total{kind="cas"}`: 1,
+		`embedded_cache_hits_total{kind="ac"}`:    0,
+		`embedded_cache_evictions_total`:          0,
+	} {
+		if got, ok := counters[series]; !ok || got != want {
+			t.Errorf("%s: got %g, want %g", series, got, want)
+		}
+	}
+	get := histograms[`embedded_blob_size_bytes{kind="cas",op="get"}`]
+	if get == nil || get.count != 3 || get.sum != 9000 {
+		t.Fatalf("unexpected get histogram: %+v", get)
+	}
+	// 3000 bytes are in the 4KiB bucket
+	if q := get.quantile(0.5); q <= 1024 || q > 4096 {
+		t.Errorf("unexpected median: %g", q)
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/hex"
+	"github.com/dustin/go-humanize"
+	"io"
+	"log"
+	"math/rand"
+	"os"
+	"sort"
+	"sync/atomic"
+)
+import "flag"
+
+var uploadMutation = flag.String("upload_mutation", "suffix", "How uploads are made unique: suffix appends 16 random bytes to the file, mutate changes bytes of the file in place")
+var mutationRatio = flag.Float64("mutation_ratio", 0.001, "Fraction of bytes changed by -upload_mutation=mutate, at least one byte")
+var mutationPositions = flag.String("mutation_positions", "uniform", "Positions of bytes changed by -upload_mutation=mutate: uniform, start or end, the latter within first or last -mutation_window bytes. Hashing resumes before the first changed byte, so only end avoids re-hashing most of the file")
+var mutationWindow = flag.Int64("mutation_window", 64<<10, "Size of the region changed with -mutation_positions start or end")
+
+// Hash state of files is saved every hashCheckpointInterval bytes, so hash of a mutated file is computed from the
+// checkpoint before the first changed byte, instead of from the start.
+const hashCheckpointInterval = 1 << 20
+
+// Bytes hashed for mutated uploads, and their total size
+var mutationHashedBytes, mutationUploadedBytes int64
+
+func checkMutationFlags() {
+	if *uploadMutation != "suffix" && *uploadMutation != "mutate" {
+		log.Fatalf("Unknown upload mutation: %s", *uploadMutation)
+	}
+	if *mutationRatio < 0 || *mutationRatio > 1 {
+		log.Fatalf("Invalid mutation ratio: %f", *mutationRatio)
+	}
+	if *mutationPositions != "uniform" && *mutationPositions != "start" && *mutationPositions != "end" {
+		log.Fatalf("Unknown mutation positions: %s", *mutationPositions)
+	}
+	if *mutationWindow <= 0 {
+		log.Fatalf("Invalid mutation window: %d", *mutationWindow)
+	}
+}
+
+// mutation is a set of changed bytes of a file, each XORed with a non-zero value.
+type mutation struct {
+	offsets []int64
+	xor     []byte
+}
+
+// newMutation returns random mutation of a file of given size, which is not empty.
+func newMutation(size int64) *mutation {
+	from, to := int64(0), size
+	switch *mutationPositions {
+	case "start":
+		if to > *mutationWindow {
+			to = *mutationWindow
+		}
+	case "end":
+		if from = size - *mutationWindow; from < 0 {
+			from = 0
+		}
+	}
+
+	n := int(*mutationRatio * float64(to-from))
+	if n < 1 {
+		n = 1
+	}
+	offsets := make([]int64, n)
+	for i := range offsets {
+		offsets[i] = from + rand.Int63n(to-from)
+	}
+	sort.Slice(offsets, func(i, j int) bool { return offsets[i] < offsets[j] })
+
+	// Same byte changed twice could be restored, so duplicates are removed
+	m := &mutation{}
+	for i, o := range offsets {
+		if i > 0 && o == offsets[i-1] {
+			continue
+		}
+		m.offsets = append(m.offsets, o)
+		m.xor = append(m.xor, byte(1+rand.Intn(255)))
+	}
+	return m
+}
+
+// mutatingReader applies the mutation to data read from r, which starts at offset pos of the file.
+type mutatingReader struct {
+	r    io.Reader
+	pos  int64
+	m    *mutation
+	next int
+}
+
+func newMutatingReader(r io.Reader, pos int64, m *mutation) *mutatingReader {
+	next := sort.Search(len(m.offsets), func(i int) bool { return m.offsets[i] >= pos })
+	return &mutatingReader{r: r, pos: pos, m: m, next: next}
+}
+
+func (r *mutatingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	end := r.pos + int64(n)
+	for r.next < len(r.m.offsets) && r.m.offsets[r.next] < end {
+		p[r.m.offsets[r.next]-r.pos] ^= r.m.xor[r.next]
+		r.next++
+	}
+	r.pos = end
+	return n, err
+}
+
+// mutatedHash returns hash of the mutated file, hashing it from the last checkpoint before the first changed byte.
+func mutatedHash(f *FileData, m *mutation) string {
+	k := m.offsets[0] / hashCheckpointInterval
+	h := f.Checkpoints[k].resume()
+
+	file, err := os.Open(f.Path)
+	noError(err)
+	defer file.Close()
+	_, err = file.Seek(k*hashCheckpointInterval, io.SeekStart)
+	noError(err)
+	n, err := io.Copy(h, newMutatingReader(file, k*hashCheckpointInterval, m))
+	noError(err)
+
+	atomic.AddInt64(&mutationHashedBytes, n)
+	atomic.AddInt64(&mutationUploadedBytes, f.Size)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func logMutations() {
+	if *uploadMutation != "mutate" {
+		return
+	}
+	log.Printf("UPLOAD    mutation ratio: %g, positions: %s, hashed %s of %s uploaded", *mutationRatio, *mutationPositions,
+		humanize.Bytes(uint64(atomic.LoadInt64(&mutationHashedBytes))), humanize.Bytes(uint64(atomic.LoadInt64(&mutationUploadedBytes))))
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"github.com/dustin/go-humanize"
+	"log"
+	"sync"
+	"time"
+)
+import "flag"
+
+var targetRate = flag.Float64("rate", 0, "Target rate of open-loop mode, in -rate_unit per second, 0 for closed-loop mode")
+var rateUnit = flag.String("rate_unit", "requests", "Unit of -rate and -rate_end: requests or bytes")
+var rateSchedule = flag.String("rate_schedule", "constant", "Rate schedule of open-loop mode: constant, ramp (linear from -rate to -rate_end over -rate_duration) or step (-rate_steps equal steps from -rate to -rate_end over -rate_duration)")
+var rateEnd = flag.Float64("rate_end", 0, "Final rate of ramp and step schedules")
+var rateDuration = flag.Duration("rate_duration", time.Minute, "Duration of ramp and step schedules, the final rate is kept afterwards")
+var rateSteps = flag.Int("rate_steps", 4, "Number of steps of the step schedule")
+var maxInflight = flag.Int("max_inflight", 1000, "Maximum number of requests in flight in open-loop mode, requests above the limit wait in queue")
+
+func openLoop() bool {
+	return *targetRate > 0
+}
+
+func checkRateFlags() {
+	if !openLoop() {
+		return
+	}
+	if *rateUnit != "requests" && *rateUnit != "bytes" {
+		log.Fatalf("Unknown rate unit: %s", *rateUnit)
+	}
+	switch *rateSchedule {
+	case "constant":
+	case "ramp", "step":
+		if *rateEnd <= 0 || *rateDuration <= 0 {
+			log.Fatalf("Rate schedule %s needs positive -rate_end and -rate_duration", *rateSchedule)
+		}
+		if *rateSchedule == "step" && *rateSteps < 1 {
+			log.Fatalf("Invalid number of rate steps: %d", *rateSteps)
+		}
+	default:
+		log.Fatalf("Unknown rate schedule: %s", *rateSchedule)
+	}
+	if *maxInflight < 1 {
+		log.Fatalf("Invalid max in-flight requests: %d", *maxInflight)
+	}
+}
+
+// scheduledRate returns target rate at time t since the start of the benchmark.
+func scheduledRate(t time.Duration) float64 {
+	if *rateSchedule == "constant" || t >= *rateDuration {
+		if *rateSchedule == "constant" {
+			return *targetRate
+		}
+		return *rateEnd
+	}
+	progress := float64(t) / float64(*rateDuration)
+	if *rateSchedule == "step" {
+		if *rateSteps == 1 {
+			return *targetRate
+		}
+		// Truncate to the start of the current step, the last step is at -rate_end
+		step := float64(int(progress * float64(*rateSteps)))
+		progress = step / float64(*rateSteps-1)
+	}
+	return *targetRate + (*rateEnd-*targetRate)*progress
+}
+
+func formatRate(units float64, d time.Duration) string {
+	rate := units / d.Seconds()
+	if *rateUnit == "bytes" {
+		return humanize.Bytes(uint64(rate)) + "/s"
+	}
+	return fmt.Sprintf("%.1f req/s", rate)
+}
+
+// runOpenLoop issues n requests at times given by the rate schedule, regardless of completion of previous requests.
+// Request i has size given by size(i), which is used for bytes rate. do is called in a new goroutine with one of
+// -parallel clients and time the request waited since it was scheduled, which is included in corrected latency.
+// If n is negative, requests are scheduled for -duration.
+func runOpenLoop(op string, n int, size func(i int) int64, do func(client *Client, i int, queue time.Duration)) {
+	clients := make([]*Client, *parallel)
+	for i := range clients {
+		clients[i] = createClient()
+	}
+	inflight := make(chan struct{}, *maxInflight)
+	var w sync.WaitGroup
+
+	start := time.Now()
+	intended := start
+	var units float64
+	for i := 0; n >= 0 && i < n || n < 0 && intended.Sub(start) < *duration; i++ {
+		if d := intended.Sub(time.Now()); d > 0 {
+			time.Sleep(d)
+		}
+		// Schedule is not delayed when the limit is reached, waiting is accounted as queueing
+		inflight <- struct{}{}
+		w.Add(1)
+		go func(i int, intended time.Time) {
+			do(clients[i%len(clients)], i, time.Now().Sub(intended))
+			<-inflight
+			w.Done()
+		}(i, intended)
+
+		cost := 1.0
+		if *rateUnit == "bytes" {
+			cost = float64(size(i))
+		}
+		units += cost
+		intended = intended.Add(time.Duration(cost / scheduledRate(intended.Sub(start)) * float64(time.Second)))
+	}
+	issued := time.Now().Sub(start)
+	w.Wait()
+	total := time.Now().Sub(start)
+
+	log.Printf("%-9s open-loop schedule: %s, target duration: %s, achieved issue rate: %s, completion rate: %s",
+		op, *rateSchedule, intended.Sub(start).Round(time.Millisecond), formatRate(units, issued), formatRate(units, total))
+}
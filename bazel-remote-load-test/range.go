@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"io"
+	"log"
+	"math/rand"
+	"os"
+	"sync/atomic"
+)
+import "flag"
+
+var rangedReads = flag.Float64("ranged_reads", 0, "Probability of a download being a ranged read with ReadOffset and ReadLimit, reported as RANGE")
+var rangeOffset = flag.String("range_offset", "uniform", "Distribution of ranged read offsets: uniform, start (offset 0) or end (last -range_limit bytes)")
+var rangeLimit = flag.Int64("range_limit", 64<<10, "Maximum number of bytes of a ranged read, 0 to read up to the end of the blob")
+
+// Number of ranged reads which did not match the local file
+var corruptedRanges int64
+
+func checkRangeFlags() {
+	if *rangedReads < 0 || *rangedReads > 1 {
+		log.Fatalf("Invalid ranged reads probability: %f", *rangedReads)
+	}
+	if *rangeOffset != "uniform" && *rangeOffset != "start" && *rangeOffset != "end" {
+		log.Fatalf("Unknown range offset distribution: %s", *rangeOffset)
+	}
+	if *rangeLimit < 0 {
+		log.Fatalf("Invalid range limit: %d", *rangeLimit)
+	}
+}
+
+// getRange returns offset and limit of a ranged read of a blob of given size.
+func getRange(size int64) (int64, int64) {
+	limit := *rangeLimit
+	if limit == 0 || limit > size {
+		limit = size
+	}
+	var offset int64
+	switch *rangeOffset {
+	case "uniform":
+		offset = rand.Int63n(size)
+	case "end":
+		offset = size - limit
+	}
+	if *rangeLimit == 0 {
+		// Up to the end of the blob
+		return offset, 0
+	}
+	return offset, limit
+}
+
+// readRange reads a random range of the file, verifies it against the local file and returns its size. Only not
+// found error is returned.
+func readRange(client *Client, f *FileData) (int64, Latency, error) {
+	offset, limit := getRange(f.Size)
+	data, l, err := client.DownloadRange(f.Size, f.Hash, offset, limit)
+	if status.Code(err) == codes.NotFound {
+		return 0, l, err
+	}
+	noError(err)
+
+	expectedSize := f.Size - offset
+	if limit > 0 && limit < expectedSize {
+		expectedSize = limit
+	}
+	expected := make([]byte, expectedSize)
+	file, err := os.Open(f.Path)
+	noError(err)
+	_, err = io.ReadFull(io.NewSectionReader(file, offset, expectedSize), expected)
+	noError(err)
+	noError(file.Close())
+
+	if !bytes.Equal(data, expected) {
+		atomic.AddInt64(&corruptedRanges, 1)
+		recordError("RANGE")
+		log.Printf("RANGE     %s", &CorruptionError{f.Path, fmt.Sprintf("range offset %d limit %d: got %d bytes, which do not match %d expected bytes", offset, limit, len(data), len(expected))})
+	}
+	return int64(len(data)), l, nil
+}
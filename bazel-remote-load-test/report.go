@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/dustin/go-humanize"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+import "flag"
+
+var duration = flag.Duration("duration", 0, "Run download and upload benchmarks for this duration instead of the number of iterations, which then only enable them; duration of -workload")
+var reportInterval = flag.Duration("report_interval", time.Second, "Interval of periodic reports of throughput, errors and latency, 0 to log every finished request instead")
+var reportJson = flag.String("report_json", "", "File to write periodic reports to as JSON lines")
+
+// intervalStats are statistics of an operation since the last periodic report.
+type intervalStats struct {
+	ops     int64
+	bytes   int64
+	errors  int64
+	latency Histogram
+}
+
+var interval = struct {
+	sync.Mutex
+	m map[string]*intervalStats
+}{m: make(map[string]*intervalStats)}
+
+func getIntervalStats(op string) *intervalStats {
+	s, ok := interval.m[op]
+	if !ok {
+		s = &intervalStats{}
+		interval.m[op] = s
+	}
+	return s
+}
+
+// Bytes of blobs and action results transferred by all operations
+var transferredBytes int64
+
+// Operations which transfer no data, their size is not counted in reported throughput
+var noDataOps = map[string]bool{"MISS": true, "NOT_FOUND": true, "AC_MISS": true, "FIND_MISSING": true}
+
+func recordInterval(op string, size int64, l Latency) {
+	if noDataOps[op] {
+		size = 0
+	}
+	atomic.AddInt64(&transferredBytes, size)
+	interval.Lock()
+	defer interval.Unlock()
+	s := getIntervalStats(op)
+	s.ops++
+	s.bytes += size
+	s.latency.Record(l.Total)
+}
+
+// recordError counts a failed request, which is reported separately from other failures, e.g. corrupted data.
+func recordError(op string) {
+	interval.Lock()
+	defer interval.Unlock()
+	getIntervalStats(op).errors++
+}
+
+// Report is a periodic report of a single operation, written as a JSON line.
+type Report struct {
+	Time        time.Time `json:"time"`
+	Elapsed     float64   `json:"elapsed_s"`
+	Op          string    `json:"op"`
+	Ops         int64     `json:"ops"`
+	OpsPerSec   float64   `json:"ops_per_sec"`
+	BytesPerSec float64   `json:"bytes_per_sec"`
+	Errors      int64     `json:"errors"`
+	LatencyP50  float64   `json:"latency_p50_ms"`
+	LatencyP90  float64   `json:"latency_p90_ms"`
+	LatencyP99  float64   `json:"latency_p99_ms"`
+	LatencyMax  float64   `json:"latency_max_ms"`
+}
+
+func toMs(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// report logs statistics of every operation since last, and returns time of the report.
+func report(start time.Time, last time.Time, enc *json.Encoder) time.Time {
+	interval.Lock()
+	m := interval.m
+	interval.m = make(map[string]*intervalStats)
+	interval.Unlock()
+
+	now := time.Now()
+	seconds := now.Sub(last).Seconds()
+	var ops []string
+	for op := range m {
+		ops = append(ops, op)
+	}
+	sort.Strings(ops)
+	for _, op := range ops {
+		s := m[op]
+		r := Report{
+			Time:        now,
+			Elapsed:     now.Sub(start).Seconds(),
+			Op:          op,
+			Ops:         s.ops,
+			OpsPerSec:   float64(s.ops) / seconds,
+			BytesPerSec: float64(s.bytes) / seconds,
+			Errors:      s.errors,
+			LatencyP50:  toMs(s.latency.Percentile(0.5)),
+			LatencyP90:  toMs(s.latency.Percentile(0.9)),
+			LatencyP99:  toMs(s.latency.Percentile(0.99)),
+			LatencyMax:  toMs(s.latency.Max()),
+		}
+		log.Printf("%-9s %6.1fs  %8.1f ops/s  %10s/s  errors: %d  p50: %s  p90: %s  p99: %s  max: %s",
+			op, r.Elapsed, r.OpsPerSec, humanize.Bytes(uint64(r.BytesPerSec)), r.Errors,
+			s.latency.Percentile(0.5).Round(time.Microsecond), s.latency.Percentile(0.9).Round(time.Microsecond),
+			s.latency.Percentile(0.99).Round(time.Microsecond), s.latency.Max().Round(time.Microsecond))
+		if enc != nil {
+			noError(enc.Encode(r))
+		}
+	}
+	return now
+}
+
+// startReporter starts periodic reports every -report_interval, returned function reports the last interval and
+// stops them.
+func startReporter() func() {
+	if *reportInterval <= 0 {
+		return func() {}
+	}
+
+	var enc *json.Encoder
+	var f *os.File
+	if *reportJson != "" {
+		var err error
+		f, err = os.Create(*reportJson)
+		noError(err)
+		enc = json.NewEncoder(f)
+	}
+
+	start := time.Now()
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(*reportInterval)
+		defer ticker.Stop()
+		last := start
+		for {
+			select {
+			case <-ticker.C:
+				last = report(start, last, enc)
+			case <-stop:
+				report(start, last, enc)
+				close(done)
+				return
+			}
+		}
+	}()
+
+	return func() {
+		close(stop)
+		<-done
+		if f != nil {
+			noError(f.Close())
+		}
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/dustin/go-humanize"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+import "flag"
+
+var serverPid = flag.Int("server_pid", 0, "PID of the server process to sample CPU time, RSS and I/O of from /proc during the run")
+var serverCgroup = flag.String("server_cgroup", "", "Directory of the cgroup v2 of the server to sample CPU time, memory and I/O of, e.g. /sys/fs/cgroup/system.slice/bazel-remote.service")
+var serverSampleInterval = flag.Duration("server_sample_interval", time.Second, "Interval of sampling server resource usage")
+
+// Clock ticks of CPU times in /proc/{pid}/stat, USER_HZ is 100 on all Linux architectures
+const clockTicks = 100
+
+// serverSample is cumulative resource usage of the server, memory is current. I/O is -1 if not available.
+type serverSample struct {
+	time       time.Time
+	cpu        time.Duration
+	memory     int64
+	readBytes  int64
+	writeBytes int64
+}
+
+func checkServerMonitorFlags() {
+	if *serverPid != 0 && *serverCgroup != "" {
+		log.Fatal("Only one of -server_pid and -server_cgroup can be used")
+	}
+	if *serverSampleInterval <= 0 {
+		log.Fatalf("Invalid server sample interval: %s", *serverSampleInterval)
+	}
+}
+
+// readKeyValues reads "key value" lines of a file, e.g. /proc/{pid}/io or cpu.stat, with sep between key and value.
+func readKeyValues(path string, sep string) (map[string]int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	m := make(map[string]int64)
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		kv := strings.SplitN(s.Text(), sep, 2)
+		if len(kv) != 2 {
+			continue
+		}
+		fields := strings.Fields(kv[1])
+		if len(fields) == 0 {
+			continue
+		}
+		if v, err := strconv.ParseInt(fields[0], 10, 64); err == nil {
+			m[strings.TrimSpace(kv[0])] = v
+		}
+	}
+	return m, s.Err()
+}
+
+func readProcSample(pid int) (serverSample, error) {
+	sample := serverSample{time: time.Now(), readBytes: -1, writeBytes: -1}
+	stat, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return sample, err
+	}
+	// Command name in parentheses may contain spaces, utime and stime are 14th and 15th fields
+	fields := strings.Fields(string(stat[strings.LastIndexByte(string(stat), ')')+1:]))
+	if len(fields) < 13 {
+		return sample, fmt.Errorf("invalid /proc/%d/stat: %s", pid, stat)
+	}
+	utime, err := strconv.ParseInt(fields[11], 10, 64)
+	if err != nil {
+		return sample, err
+	}
+	stime, err := strconv.ParseInt(fields[12], 10, 64)
+	if err != nil {
+		return sample, err
+	}
+	sample.cpu = time.Duration(utime+stime) * time.Second / clockTicks
+
+	status, err := readKeyValues(fmt.Sprintf("/proc/%d/status", pid), ":")
+	if err != nil {
+		return sample, err
+	}
+	sample.memory = status["VmRSS"] * 1024
+
+	// Needs the same user as the server, or root
+	if io, err := readKeyValues(fmt.Sprintf("/proc/%d/io", pid), ":"); err == nil {
+		sample.readBytes, sample.writeBytes = io["read_bytes"], io["write_bytes"]
+	}
+	return sample, nil
+}
+
+func readCgroupSample(dir string) (serverSample, error) {
+	sample := serverSample{time: time.Now(), readBytes: -1, writeBytes: -1}
+	cpu, err := readKeyValues(filepath.Join(dir, "cpu.stat"), " ")
+	if err != nil {
+		return sample, err
+	}
+	sample.cpu = time.Duration(cpu["usage_usec"]) * time.Microsecond
+
+	memory, err := ioutil.ReadFile(filepath.Join(dir, "memory.current"))
+	if err != nil {
+		return sample, err
+	}
+	if sample.memory, err = strconv.ParseInt(strings.TrimSpace(string(memory)), 10, 64); err != nil {
+		return sample, err
+	}
+
+	// Lines of devices with rbytes=... wbytes=... fields
+	if io, err := ioutil.ReadFile(filepath.Join(dir, "io.stat")); err == nil {
+		sample.readBytes, sample.writeBytes = 0, 0
+		for _, field := range strings.Fields(string(io)) {
+			kv := strings.SplitN(field, "=", 2)
+			if len(kv) != 2 {
+				continue
+			}
+			v, _ := strconv.ParseInt(kv[1], 10, 64)
+			switch kv[0] {
+			case "rbytes":
+				sample.readBytes += v
+			case "wbytes":
+				sample.writeBytes += v
+			}
+		}
+	}
+	return sample, nil
+}
+
+func readServerSample() (serverSample, error) {
+	if *serverPid != 0 {
+		return readProcSample(*serverPid)
+	}
+	return readCgroupSample(*serverCgroup)
+}
+
+func formatIo(bytes int64) string {
+	if bytes < 0 {
+		return "n/a"
+	}
+	return humanize.Bytes(uint64(bytes))
+}
+
+// startServerMonitor samples resource usage of the server every -server_sample_interval, logging CPU usage and
+// memory of every interval. Returned function stops sampling and logs usage of the whole run, with CPU time per GB
+// transferred by the client.
+func startServerMonitor() func() {
+	if *serverPid == 0 && *serverCgroup == "" {
+		return func() {}
+	}
+
+	first, err := readServerSample()
+	noError(err)
+	stop := make(chan struct{})
+	done := make(chan serverSample)
+	go func() {
+		ticker := time.NewTicker(*serverSampleInterval)
+		defer ticker.Stop()
+		last := first
+		maxMemory := first.memory
+		for {
+			select {
+			case <-ticker.C:
+			case <-stop:
+				last.memory = maxMemory
+				done <- last
+				return
+			}
+			s, err := readServerSample()
+			if err != nil {
+				log.Printf("SERVER    failed to sample: %s", err)
+				continue
+			}
+			if s.memory > maxMemory {
+				maxMemory = s.memory
+			}
+			log.Printf("SERVER    %6.1fs  cpu: %5.2f cores  memory: %s", s.time.Sub(first.time).Seconds(),
+				(s.cpu-last.cpu).Seconds()/s.time.Sub(last.time).Seconds(), humanize.IBytes(uint64(s.memory)))
+			last = s
+		}
+	}()
+
+	return func() {
+		close(stop)
+		// Last sample has max memory instead of current
+		last := <-done
+		if s, err := readServerSample(); err == nil {
+			if s.memory < last.memory {
+				s.memory = last.memory
+			}
+			last = s
+		}
+
+		cpu := last.cpu - first.cpu
+		elapsed := last.time.Sub(first.time)
+		transferred := atomic.LoadInt64(&transferredBytes)
+		perGb := "n/a"
+		if transferred > 0 {
+			perGb = fmt.Sprintf("%.2fs", cpu.Seconds()/(float64(transferred)/1e9))
+		}
+		read, written := int64(-1), int64(-1)
+		if first.readBytes >= 0 && last.readBytes >= 0 {
+			read, written = last.readBytes-first.readBytes, last.writeBytes-first.writeBytes
+		}
+		log.Printf("SERVER    cpu: %s (%.2f cores)  max memory: %s  read: %s  written: %s  transferred by client: %s  cpu per GB: %s",
+			cpu.Round(time.Millisecond), cpu.Seconds()/elapsed.Seconds(), humanize.IBytes(uint64(last.memory)), formatIo(read),
+			formatIo(written), humanize.Bytes(uint64(transferred)), perGb)
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"io/ioutil"
+	"log"
+)
+import "flag"
+
+var useTls = flag.Bool("tls", false, "Connect with TLS, the embedded server also serves TLS with generated certificates")
+var tlsCaFile = flag.String("tls_ca_file", "", "PEM file with CA certificates to verify the server, system roots if empty")
+var tlsCertFile = flag.String("tls_cert_file", "", "PEM file with client certificate for mTLS")
+var tlsKeyFile = flag.String("tls_key_file", "", "PEM file with client key for mTLS")
+var tlsServerName = flag.String("tls_server_name", "", "Server name to verify, host of -addr if empty")
+var authToken = flag.String("auth_token", "", "Bearer token sent with every request, also required by the embedded server if set")
+
+// CA and client certificate generated by the embedded server, used if files are not given
+var embeddedCa *x509.CertPool
+var embeddedClientCert *tls.Certificate
+
+func checkTlsFlags() {
+	if (*tlsCertFile == "") != (*tlsKeyFile == "") {
+		log.Fatal("Need both -tls_cert_file and -tls_key_file for mTLS")
+	}
+	if *authToken != "" && *httpUser != "" {
+		log.Fatal("Only one of -auth_token and -http_user can be used")
+	}
+}
+
+func clientTlsConfig() *tls.Config {
+	cfg := &tls.Config{ServerName: *tlsServerName, RootCAs: embeddedCa}
+	if *tlsCaFile != "" {
+		pem, err := ioutil.ReadFile(*tlsCaFile)
+		noError(err)
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			log.Fatalf("No certificates in %s", *tlsCaFile)
+		}
+	}
+	if *tlsCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(*tlsCertFile, *tlsKeyFile)
+		noError(err)
+		cfg.Certificates = []tls.Certificate{cert}
+	} else if embeddedClientCert != nil {
+		cfg.Certificates = []tls.Certificate{*embeddedClientCert}
+	}
+	return cfg
+}
+
+// authHeader returns value of the authorization header or metadata, empty if no auth is configured.
+func authHeader() string {
+	if *authToken != "" {
+		return "Bearer " + *authToken
+	}
+	if *httpUser != "" {
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(*httpUser+":"+*httpPassword))
+	}
+	return ""
+}
+
+// authCredentials sends authorization metadata with every RPC.
+type authCredentials struct{}
+
+func (authCredentials) GetRequestMetadata(context.Context, ...string) (map[string]string, error) {
+	return map[string]string{"authorization": authHeader()}, nil
+}
+
+func (authCredentials) RequireTransportSecurity() bool {
+	// Allowed without TLS for testing
+	return false
+}
+
+func grpcDialOptions() []grpc.DialOption {
+	var opts []grpc.DialOption
+	if *useTls {
+		opts = append(opts, grpc.WithTransportCredentials(credentials.NewTLS(clientTlsConfig())))
+	} else {
+		opts = append(opts, grpc.WithInsecure())
+	}
+	if authHeader() != "" {
+		opts = append(opts, grpc.WithPerRPCCredentials(authCredentials{}))
+	}
+	return opts
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
+	"net/http"
+	"testing"
+)
+
+// wrongCredentials sends authorization metadata which the embedded server does not expect.
+type wrongCredentials struct{}
+
+func (wrongCredentials) GetRequestMetadata(context.Context, ...string) (map[string]string, error) {
+	return map[string]string{"authorization": "Bearer wrong"}, nil
+}
+
+func (wrongCredentials) RequireTransportSecurity() bool {
+	return true
+}
+
+// wrongAuthRoundTripper replaces the authorization header of every request.
+type wrongAuthRoundTripper struct {
+	http.RoundTripper
+}
+
+func (rt wrongAuthRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", "Bearer wrong")
+	return rt.RoundTripper.RoundTrip(req)
+}
+
+// setAuth configures the token or basic auth, which both the client and the embedded server use.
+func setAuth(t *testing.T, auth string) {
+	switch auth {
+	case "token":
+		setString(t, authToken, "secret")
+	case "basic":
+		setString(t, httpUser, "user")
+		setString(t, httpPassword, "password")
+	}
+}
+
+// roundTrip uploads and downloads blobs of testSizes.
+func roundTrip(t *testing.T, client *Client, name string) {
+	for _, size := range testSizes {
+		data, hash := testBlob(size)
+		if _, err := client.Upload(openBytes(data), int64(size), hash); err != nil {
+			t.Fatalf("%s, size: %d, upload: %s", name, size, err)
+		}
+		if _, err := client.Download(int64(size), hash); err != nil {
+			t.Fatalf("%s, size: %d, download: %s", name, size, err)
+		}
+	}
+}
+
+func TestEmbeddedTlsRoundTrip(t *testing.T) {
+	setBool(t, verifyDownloads, true)
+	setBool(t, useTls, true)
+	for _, mtls := range []bool{false, true} {
+		for _, auth := range []string{"", "token", "basic"} {
+			setBool(t, embeddedMtls, mtls)
+			setString(t, authToken, "")
+			setString(t, httpUser, "")
+			setString(t, httpPassword, "")
+			setAuth(t, auth)
+			grpcAddr, httpAddr := startEmbeddedServer()
+			name := fmt.Sprintf("mtls: %t, auth: %s", mtls, auth)
+
+			setString(t, transport, "grpc")
+			setString(t, addr, grpcAddr)
+			roundTrip(t, createClient(), "grpc, "+name)
+
+			setString(t, transport, "http")
+			setString(t, addr, "https://"+httpAddr)
+			roundTrip(t, createClient(), "http, "+name)
+		}
+	}
+}
+
+func TestEmbeddedTlsWrongCredentials(t *testing.T) {
+	setBool(t, useTls, true)
+	setBool(t, embeddedMtls, true)
+	setAuth(t, "token")
+	grpcAddr, httpAddr := startEmbeddedServer()
+	data, hash := testBlob(1000)
+
+	// Wrong and missing token
+	for _, opt := range []grpc.DialOption{grpc.WithPerRPCCredentials(wrongCredentials{}), grpc.EmptyDialOption{}} {
+		conn, err := grpc.Dial(grpcAddr, grpc.WithTransportCredentials(credentials.NewTLS(clientTlsConfig())), opt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		client := &Client{Transport: newGrpcTransport(conn)}
+		if _, err := client.Upload(openBytes(data), int64(len(data)), hash); status.Code(err) != codes.Unauthenticated {
+			t.Fatalf("expected unauthenticated upload, got: %v", err)
+		}
+		if _, err := client.Download(int64(len(data)), hash); status.Code(err) != codes.Unauthenticated {
+			t.Fatalf("expected unauthenticated download, got: %v", err)
+		}
+	}
+
+	tr := newHttpRoundTripper("https://" + httpAddr)
+	client := &Client{Transport: &httpTransport{client: &http.Client{Transport: wrongAuthRoundTripper{tr}}, base: "https://" + httpAddr}}
+	if _, err := client.Upload(openBytes(data), int64(len(data)), hash); status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("expected unauthorized http upload, got: %v", err)
+	}
+	if _, err := client.Download(int64(len(data)), hash); status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("expected unauthorized http download, got: %v", err)
+	}
+
+	// Right token, but no client certificate
+	cfg := clientTlsConfig()
+	cfg.Certificates = nil
+	conn, err := grpc.Dial(grpcAddr, grpc.WithTransportCredentials(credentials.NewTLS(cfg)), grpc.WithPerRPCCredentials(authCredentials{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := newGrpcTransport(conn).Download(int64(len(data)), hash); err == nil || status.Code(err) == codes.NotFound {
+		t.Fatalf("expected failed handshake without client certificate, got: %v", err)
+	}
+	httpClient := &http.Client{Transport: &http.Transport{TLSClientConfig: cfg}}
+	if resp, err := httpClient.Get("https://" + httpAddr + "/cas/" + hash); err == nil {
+		resp.Body.Close()
+		t.Fatalf("expected failed handshake without client certificate, got: %s", resp.Status)
+	}
+
+	// Client which does not trust the generated CA
+	conn, err = grpc.Dial(grpcAddr, grpc.WithTransportCredentials(credentials.NewTLS(&tls.Config{})), grpc.WithPerRPCCredentials(authCredentials{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := newGrpcTransport(conn).Download(int64(len(data)), hash); err == nil || status.Code(err) == codes.NotFound {
+		t.Fatalf("expected unverified server certificate, got: %v", err)
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"google.golang.org/genproto/googleapis/bytestream"
+	"google.golang.org/grpc"
+	"log"
+)
+import "flag"
+
+var transport = flag.String("transport", "grpc", "Protocol used to access the cache: grpc or http, -addr is base URL of the cache for http")
+
+// Transport transfers CAS blobs and action results, hiding the protocol from benchmarks. Download and Upload verify
+// the data the same way for all protocols, and missing blobs and action results are reported as codes.NotFound.
+type Transport interface {
+	Download(size int64, sha256 string) (Latency, error)
+	// DownloadRange returns limit bytes of the blob starting at offset, up to the end of the blob if limit is 0
+	DownloadRange(size int64, sha256 string, offset int64, limit int64) ([]byte, Latency, error)
+	Upload(open uploadSource, size int64, sha256 string) (Latency, error)
+	GetActionResult(digest *remoteexecution.Digest) (*remoteexecution.ActionResult, error)
+	UpdateActionResult(digest *remoteexecution.Digest, ar *remoteexecution.ActionResult) error
+}
+
+func checkTransport() {
+	switch *transport {
+	case "grpc":
+	case "http":
+		if *casIterations > 0 {
+			log.Fatal("-cas_iterations needs grpc transport")
+		}
+	default:
+		log.Fatalf("Unknown transport: %s", *transport)
+	}
+}
+
+// grpcTransport uses ByteStream for blobs and ActionCache service for action results.
+type grpcTransport struct {
+	bs bytestream.ByteStreamClient
+	ac remoteexecution.ActionCacheClient
+}
+
+func newGrpcTransport(conn *grpc.ClientConn) *grpcTransport {
+	return &grpcTransport{
+		bs: bytestream.NewByteStreamClient(conn),
+		ac: remoteexecution.NewActionCacheClient(conn),
+	}
+}
+
+func (t *grpcTransport) Download(size int64, sha256 string) (Latency, error) {
+	return downloadFile(t.bs, size, sha256)
+}
+
+func (t *grpcTransport) DownloadRange(size int64, sha256 string, offset int64, limit int64) ([]byte, Latency, error) {
+	return downloadRange(t.bs, size, sha256, offset, limit)
+}
+
+func (t *grpcTransport) Upload(open uploadSource, size int64, sha256 string) (Latency, error) {
+	return uploadFromReader(t.bs, open, size, sha256)
+}
+
+func (t *grpcTransport) GetActionResult(digest *remoteexecution.Digest) (*remoteexecution.ActionResult, error) {
+	return t.ac.GetActionResult(context.Background(), &remoteexecution.GetActionResultRequest{
+		InstanceName:   *instanceName,
+		ActionDigest:   digest,
+		DigestFunction: digestFunctionValue(),
+	})
+}
+
+func (t *grpcTransport) UpdateActionResult(digest *remoteexecution.Digest, ar *remoteexecution.ActionResult) error {
+	_, err := t.ac.UpdateActionResult(context.Background(), &remoteexecution.UpdateActionResultRequest{
+		InstanceName:   *instanceName,
+		ActionDigest:   digest,
+		ActionResult:   ar,
+		DigestFunction: digestFunctionValue(),
+	})
+	return err
+}
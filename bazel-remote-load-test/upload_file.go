@@ -1,74 +1,337 @@
 package main
 
 import (
+	"bufio"
 	"context"
 	"errors"
 	"fmt"
+	"github.com/dustin/go-humanize"
 	"github.com/google/uuid"
 	"google.golang.org/genproto/googleapis/bytestream"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
 	"os"
 	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
 )
 import "flag"
 
-var uploadTpl = flag.String("upload_template", "instance-name/uploads/{uuid}/blobs/{sha256}/{size}", "Resource name, upload template")
+var uploadTpl = flag.String("upload_template", "instance-name/uploads/{uuid}/blobs/{hash}/{size}", "Resource name, upload template")
+var compressedUploadTpl = flag.String("compressed_upload_template", "instance-name/uploads/{uuid}/compressed-blobs/zstd/{hash}/{size}", "Resource name, upload template for -compressed_blobs")
 
-func uploadFile(client bytestream.ByteStreamClient, path string, size int64, sha256 string) error {
-	f, err := os.Open(path)
-	defer f.Close()
+// uploadSource opens data of an upload. Interrupted uploads open it again to resume, instead of keeping sent data
+// in memory.
+type uploadSource func() (io.ReadCloser, error)
+
+// readCloser reads from Reader, which wraps the data closed by Closer.
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// uploadFile uploads the file, retrying uploads cancelled by -cancel_uploads, so it always ends up in the cache.
+func uploadFile(client *Client, path string, size int64, sha256 string) error {
+	for {
+		_, err := client.Upload(func() (io.ReadCloser, error) { return os.Open(path) }, size, sha256)
+		if err != errUploadCancelled {
+			return err
+		}
+	}
+}
+
+// Upload faults, which are chosen for every upload with given probability
+var interruptUploads = flag.Float64("interrupt_uploads", 0, "Probability of interrupting an upload at a random offset, querying committed size with QueryWriteStatus and resuming it")
+var cancelUploads = flag.Float64("cancel_uploads", 0, "Probability of cancelling an upload stream at a random offset without resuming it, to test the server with abandoned partial writes")
+
+// errUploadCancelled is returned for uploads cancelled by -cancel_uploads.
+var errUploadCancelled = errors.New("upload cancelled")
+
+// errStreamInterrupted is returned by writeStream when it stopped the stream.
+var errStreamInterrupted = errors.New("stream interrupted")
+
+// errResumeUnsupported is returned by queryCommitted when the server does not support QueryWriteStatus.
+var errResumeUnsupported = errors.New("QueryWriteStatus is not supported")
+
+var interruptedUploads, resumedUploads, restartedUploads, cancelledUploads int64
+
+// Number of interrupted uploads restarted from 0 because the server does not support QueryWriteStatus
+var unsupportedQueries int64
+
+var uploadChunkSize = flag.Int("upload_chunk_size", 1<<16, "Size of data of every WriteRequest of ByteStream uploads")
+var finishWithLastChunk = flag.Bool("finish_with_last_chunk", false, "Set FinishWrite on the last WriteRequest with data, instead of sending an extra empty WriteRequest")
+
+// Number of WriteRequest messages sent by ByteStream uploads
+var uploadMessages int64
+
+func checkUploadFaults() {
+	if *interruptUploads < 0 || *cancelUploads < 0 || *interruptUploads+*cancelUploads > 1 {
+		log.Fatalf("Invalid upload fault probabilities, interrupt: %f, cancel: %f", *interruptUploads, *cancelUploads)
+	}
+	if *interruptUploads+*cancelUploads > 0 && *transport != "grpc" {
+		log.Fatal("Upload faults need grpc transport")
+	}
+}
+
+func checkUploadChunkSize() {
+	if *uploadChunkSize <= 0 {
+		log.Fatalf("Invalid upload chunk size: %d", *uploadChunkSize)
+	}
+}
+
+// logUploadMessages logs the upload streaming strategy and number of sent messages, whose granularity affects server
+// CPU usage and throughput.
+func logUploadMessages() {
+	if *transport != "grpc" {
+		return
+	}
+	finish := "empty message"
+	if *finishWithLastChunk {
+		finish = "last chunk"
+	}
+	log.Printf("UPLOAD    chunk size: %s, finished by %s, write requests: %d", humanize.IBytes(uint64(*uploadChunkSize)),
+		finish, atomic.LoadInt64(&uploadMessages))
+}
+
+func logUploadFaults() {
+	if *interruptUploads > 0 {
+		log.Printf("UPLOAD    interrupted: %d, resumed: %d, restarted from 0: %d, QueryWriteStatus unsupported: %d",
+			atomic.LoadInt64(&interruptedUploads), atomic.LoadInt64(&resumedUploads), atomic.LoadInt64(&restartedUploads),
+			atomic.LoadInt64(&unsupportedQueries))
+	}
+	if *cancelUploads > 0 {
+		log.Printf("UPLOAD    cancelled: %d", atomic.LoadInt64(&cancelledUploads))
+	}
+}
+
+// openUpload opens data sent by the upload, compressed with -compressed_blobs.
+func openUpload(open uploadSource) (io.ReadCloser, error) {
+	r, err := open()
+	if err != nil || !*compressedBlobs {
+		return r, err
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		_ = pw.CloseWithError(zstdCompress(pw, r))
+		_ = r.Close()
+	}()
+	// Closing the pipe stops compression
+	return pr, nil
+}
+
+// sentSize returns number of bytes sent by the upload, compressing the data to count them with -compressed_blobs.
+func sentSize(open uploadSource, size int64) (int64, error) {
+	if !*compressedBlobs {
+		return size, nil
+	}
+	r, err := open()
 	if err != nil {
-		return err
+		return 0, err
 	}
+	defer r.Close()
+	var n byteCounter
+	err = zstdCompress(&n, r)
+	return int64(n), err
+}
+
+// byteCounter counts written bytes.
+type byteCounter int64
 
-	return uploadFromReader(client, f, size, sha256)
+func (c *byteCounter) Write(p []byte) (int, error) {
+	*c += byteCounter(len(p))
+	return len(p), nil
 }
 
-func uploadFromReader(client bytestream.ByteStreamClient, f io.Reader, size int64, sha256 string) error {
+// uploadResourceName returns resource name of a new upload.
+func uploadResourceName(size int64, sha256 string) string {
+	tpl := *uploadTpl
+	if *compressedBlobs {
+		tpl = *compressedUploadTpl
+	}
+
 	uuid := uuid.New()
-	rn := strings.ReplaceAll(*uploadTpl, "{uuid}", uuid.String())
-	rn = strings.ReplaceAll(rn, "{sha256}", sha256)
-	rn = strings.ReplaceAll(rn, "{size}", strconv.FormatInt(size, 10))
+	rn := strings.ReplaceAll(tpl, "{uuid}", uuid.String())
+	rn = resourceName(rn, sha256)
+	return strings.ReplaceAll(rn, "{size}", strconv.FormatInt(size, 10))
+}
+
+func uploadFromReader(client bytestream.ByteStreamClient, open uploadSource, size int64, sha256 string) (Latency, error) {
+	rn := uploadResourceName(size, sha256)
+
+	var l Latency
+	start := time.Now()
 
-	wc, err := client.Write(context.Background())
+	// Interrupted at random offset of sent data, compressed data is counted before the upload
+	fault := rand.Float64()
+	interrupt := fault < *interruptUploads
+	cancel := !interrupt && fault < *interruptUploads+*cancelUploads
+	stopAt := int64(-1)
+	if interrupt || cancel {
+		sent, err := sentSize(open, size)
+		if err != nil {
+			return l, err
+		}
+		if sent > 0 {
+			stopAt = rand.Int63n(sent)
+		}
+	}
+
+	r, err := openUpload(open)
+	if err != nil {
+		return l, err
+	}
+	resp, offset, sentTime, err := writeStream(client, rn, r, 0, stopAt, cancel)
+	_ = r.Close()
+	if err == errStreamInterrupted {
+		if cancel {
+			atomic.AddInt64(&cancelledUploads, 1)
+			return l, errUploadCancelled
+		}
+		atomic.AddInt64(&interruptedUploads, 1)
+
+		var committed int64
+		var complete bool
+		committed, complete, err = queryCommitted(client, rn, offset)
+		if err == errResumeUnsupported {
+			// Server may still have the partial write, so it is restarted as a new upload
+			atomic.AddInt64(&unsupportedQueries, 1)
+			rn = uploadResourceName(size, sha256)
+			err = nil
+		}
+		if err != nil {
+			return l, err
+		}
+		if complete {
+			l.Total = time.Now().Sub(start)
+			return l, nil
+		}
+		if committed > 0 {
+			atomic.AddInt64(&resumedUploads, 1)
+		} else {
+			atomic.AddInt64(&restartedUploads, 1)
+		}
+		// Data is read again up to the committed offset, compression is deterministic
+		if r, err = openUpload(open); err != nil {
+			return l, err
+		}
+		if _, err = io.CopyN(ioutil.Discard, r, committed); err != nil {
+			_ = r.Close()
+			return l, err
+		}
+		resp, offset, sentTime, err = writeStream(client, rn, r, committed, -1, false)
+		_ = r.Close()
+	}
+	l.First = time.Now().Sub(sentTime)
+	l.Total = time.Now().Sub(start)
 	if err != nil {
-		return err
+		return l, err
 	}
 
-	buff := make([]byte, 1<<16)
-	var offset int64
+	if *compressedBlobs {
+		// Compressed size is committed, or -1 if the blob already existed
+		if resp.CommittedSize != offset && resp.CommittedSize != -1 {
+			return l, errors.New(fmt.Sprintf("Commited size %d != compressed size %d", resp.CommittedSize, offset))
+		}
+	} else if resp.CommittedSize != size {
+		return l, errors.New(fmt.Sprintf("Commited size %d != actual size %d", resp.CommittedSize, size))
+	}
+
+	return l, nil
+}
+
+// queryCommitted returns size committed by an interrupted write, which sent data up to offset. Write which is not
+// known to the server is restarted from 0, errResumeUnsupported is returned if the server does not support
+// QueryWriteStatus.
+func queryCommitted(client bytestream.ByteStreamClient, rn string, offset int64) (int64, bool, error) {
+	resp, err := client.QueryWriteStatus(context.Background(), &bytestream.QueryWriteStatusRequest{ResourceName: rn})
+	switch status.Code(err) {
+	case codes.NotFound:
+		return 0, false, nil
+	case codes.Unimplemented, codes.Unavailable:
+		return 0, false, errResumeUnsupported
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	if resp.Complete {
+		return resp.CommittedSize, true, nil
+	}
+	if resp.CommittedSize < 0 || resp.CommittedSize > offset {
+		return 0, false, fmt.Errorf("QueryWriteStatus of %s returned committed size %d, sent %d", rn, resp.CommittedSize, offset)
+	}
+	return resp.CommittedSize, false, nil
+}
+
+// writeStream sends data from r with a new Write stream, starting at offset. If stopAt is not negative, the stream
+// is stopped without finishing the write once more than stopAt bytes were sent, and errStreamInterrupted is
+// returned. Stopped stream is cancelled if abort is set, or closed and the server response awaited otherwise.
+// Returns offset after the sent data and time when the last data was sent.
+func writeStream(client bytestream.ByteStreamClient, rn string, r io.Reader, offset int64, stopAt int64, abort bool) (*bytestream.WriteResponse, int64, time.Time, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	wc, err := client.Write(ctx)
+	if err != nil {
+		return nil, offset, time.Now(), err
+	}
+
+	chunk := make([]byte, *uploadChunkSize)
+	var br *bufio.Reader
+	if *finishWithLastChunk {
+		br = bufio.NewReaderSize(r, *uploadChunkSize)
+		r = br
+	}
 	for {
-		n, err := f.Read(buff)
-		if err != nil && err != io.EOF {
+		n, err := io.ReadFull(r, chunk)
+		eof := err == io.EOF || err == io.ErrUnexpectedEOF
+		if err != nil && !eof {
 			_ = wc.CloseSend()
-			return err
+			return nil, offset, time.Now(), err
+		}
+		if br != nil && !eof {
+			// Look ahead, so the write is finished by the last chunk with data
+			if _, err := br.Peek(1); err == io.EOF {
+				eof = true
+			} else if err != nil {
+				_ = wc.CloseSend()
+				return nil, offset, time.Now(), err
+			}
 		}
-		finishWrite := n == 0 && err == io.EOF
+		// Finished by an extra empty message after the data, unless -finish_with_last_chunk is set. Stopped stream
+		// is never finished, even if the stop offset is in the last chunk.
+		stop := stopAt >= 0 && offset+int64(n) > stopAt
+		finishWrite := eof && (br != nil || n == 0) && !stop
 		err = wc.Send(&bytestream.WriteRequest{
 			ResourceName: rn,
 			WriteOffset:  offset,
 			FinishWrite:  finishWrite,
-			Data:         buff[:n],
+			Data:         chunk[:n],
 		})
 		if err != nil {
 			break
 		}
+		atomic.AddInt64(&uploadMessages, 1)
+		offset += int64(n)
 
 		if finishWrite {
 			break
 		}
-		offset += int64(n)
+		if stop {
+			if abort {
+				cancel()
+			} else {
+				// Server may respond with committed size or an error, it is checked with QueryWriteStatus
+				_, _ = wc.CloseAndRecv()
+			}
+			return nil, offset, time.Now(), errStreamInterrupted
+		}
 	}
 
+	sent := time.Now()
 	resp, err := wc.CloseAndRecv()
-	if err != nil {
-		return err
-	}
-
-	if resp.CommittedSize != size {
-		return errors.New(fmt.Sprintf("Commited size %d != actual size %d", resp.CommittedSize, size))
-	}
-
-	return nil
+	return resp, offset, sent, err
 }
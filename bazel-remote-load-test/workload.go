@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"github.com/dustin/go-humanize"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"io"
+	"log"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+import "flag"
+
+var workloadProfile = flag.String("workload", "", "Mixed workload profile as weights of operations, e.g. read=80,write=15,miss=5, run for -duration instead of download and upload benchmarks")
+var workloadBlobs = flag.Int("workload_blobs", 0, "Number of generated blobs read by the mixed workload, 0 to read files from -dir")
+var workloadBlobSizes = flag.String("workload_blob_sizes", "4KiB=60,64KiB=25,1MiB=10,16MiB=5", "Size distribution of generated blobs as weights of sizes")
+var zipfS = flag.Float64("zipf_s", 1.1, "Zipf s parameter of blob popularity, must be > 1, higher values make popular blobs read more often")
+var zipfV = flag.Float64("zipf_v", 1, "Zipf v parameter of blob popularity, must be >= 1")
+
+const (
+	opRead  = "read"
+	opWrite = "write"
+	opMiss  = "miss"
+)
+
+// workloadBlob is a blob read and modified by the mixed workload, either a file or generated random data.
+type workloadBlob struct {
+	// Path of the file, empty for generated blob
+	path string
+	// Seed of random data of generated blob
+	seed int64
+	size int64
+
+	hash      string
+	hashState hashState
+}
+
+func (b *workloadBlob) open() (io.ReadCloser, error) {
+	if b.path != "" {
+		return os.Open(b.path)
+	}
+	return io.NopCloser(io.LimitReader(rand.New(rand.NewSource(b.seed)), b.size)), nil
+}
+
+func newGeneratedBlob(seed int64, size int64) *workloadBlob {
+	b := &workloadBlob{seed: seed, size: size}
+	r, err := b.open()
+	noError(err)
+	h := newHash()
+	_, err = io.Copy(h, r)
+	noError(err)
+	b.hashState = saveHashState(h)
+	b.hash = hex.EncodeToString(h.Sum(nil))
+	return b
+}
+
+// parseWeights parses comma separated key=weight pairs.
+func parseWeights(s string) ([]string, []float64) {
+	var keys []string
+	var weights []float64
+	for _, kv := range strings.Split(s, ",") {
+		parts := strings.Split(kv, "=")
+		if len(parts) != 2 {
+			log.Fatalf("Invalid weight: %s", kv)
+		}
+		w, err := strconv.ParseFloat(parts[1], 64)
+		if err != nil || w < 0 {
+			log.Fatalf("Invalid weight: %s", kv)
+		}
+		keys = append(keys, strings.TrimSpace(parts[0]))
+		weights = append(weights, w)
+	}
+	return keys, weights
+}
+
+// weightedChoice returns index of a weight chosen with probability proportional to it.
+func weightedChoice(r *rand.Rand, weights []float64) int {
+	var total float64
+	for _, w := range weights {
+		total += w
+	}
+	x := r.Float64() * total
+	for i, w := range weights {
+		if x < w {
+			return i
+		}
+		x -= w
+	}
+	return len(weights) - 1
+}
+
+func checkWorkloadFlags() {
+	if *workloadProfile == "" {
+		return
+	}
+	ops, _ := parseWeights(*workloadProfile)
+	for _, op := range ops {
+		if op != opRead && op != opWrite && op != opMiss {
+			log.Fatalf("Unknown workload operation: %s", op)
+		}
+	}
+	if *zipfS <= 1 || *zipfV < 1 {
+		log.Fatalf("Invalid zipf parameters, s: %f, v: %f", *zipfS, *zipfV)
+	}
+	if openLoop() {
+		log.Fatal("Open-loop mode is not supported with -workload")
+	}
+	if *duration <= 0 {
+		log.Fatal("Need to specify -duration of -workload")
+	}
+}
+
+// getWorkloadBlobs returns blobs read by the workload, generating and uploading them if -workload_blobs is set.
+func getWorkloadBlobs(files []*FileData) []*workloadBlob {
+	var blobs []*workloadBlob
+	if *workloadBlobs == 0 {
+		for _, f := range files {
+			blobs = append(blobs, &workloadBlob{path: f.Path, size: f.Size, hash: f.Hash, hashState: f.HashState})
+		}
+		return blobs
+	}
+
+	names, weights := parseWeights(*workloadBlobSizes)
+	var sizes []int64
+	for _, n := range names {
+		s, err := humanize.ParseBytes(n)
+		if err != nil {
+			log.Fatalf("Invalid blob size: %s", n)
+		}
+		sizes = append(sizes, int64(s))
+	}
+
+	start := time.Now()
+	client := createClient()
+	r := rand.New(rand.NewSource(rand.Int63()))
+	var total uint64
+	for i := 0; i < *workloadBlobs; i++ {
+		b := newGeneratedBlob(r.Int63(), sizes[weightedChoice(r, weights)])
+		for {
+			_, err := client.Upload(b.open, b.size, b.hash)
+			if err != errUploadCancelled {
+				noError(err)
+				break
+			}
+		}
+		blobs = append(blobs, b)
+		total += uint64(b.size)
+	}
+	log.Printf("Uploaded %d generated blobs, size: %s in %s", len(blobs), humanize.IBytes(total), time.Now().Sub(start))
+	return blobs
+}
+
+type workloadCounters struct {
+	ops   int64
+	bytes int64
+}
+
+// runWorkload runs -parallel clients for -duration, each choosing operations with weights of the profile. Reads
+// choose blobs by Zipf popularity, writes upload a popular blob with random bytes appended, and misses read blobs
+// which do not exist.
+func runWorkload(files []*FileData) {
+	blobs := getWorkloadBlobs(files)
+	ops, weights := parseWeights(*workloadProfile)
+	counters := make([]workloadCounters, len(ops))
+
+	// Popularity rank is independent of size
+	popularity := rand.Perm(len(blobs))
+
+	log.Printf("WORKLOAD  %s, blobs: %d, duration: %s", *workloadProfile, len(blobs), *duration)
+	start := time.Now()
+	deadline := start.Add(*duration)
+	var w sync.WaitGroup
+	for i := 0; i < *parallel; i++ {
+		w.Add(1)
+		go func(clientIdx int) {
+			defer w.Done()
+			client := createClient()
+			r := rand.New(rand.NewSource(rand.Int63()))
+			zipf := rand.NewZipf(r, *zipfS, *zipfV, uint64(len(blobs)-1))
+			for time.Now().Before(deadline) {
+				op := weightedChoice(r, weights)
+				b := blobs[popularity[zipf.Uint64()]]
+				size := runWorkloadOp(client, r, ops[op], b)
+				atomic.AddInt64(&counters[op].ops, 1)
+				atomic.AddInt64(&counters[op].bytes, size)
+			}
+		}(i)
+	}
+	w.Wait()
+
+	elapsed := time.Now().Sub(start)
+	for i, op := range ops {
+		c := counters[i]
+		log.Printf("WORKLOAD  %-5s ops: %d  %.1f ops/s  size: %s  throughput: %s/s", op, c.ops,
+			float64(c.ops)/elapsed.Seconds(), humanize.Bytes(uint64(c.bytes)),
+			humanize.Bytes(uint64(float64(c.bytes)/elapsed.Seconds())))
+	}
+	if corrupted := atomic.LoadInt64(&corruptedDownloads); *verifyDownloads || *compressedBlobs || corrupted > 0 {
+		log.Printf("WORKLOAD  corrupted: %d", corrupted)
+	}
+	logUploadMessages()
+	logUploadFaults()
+}
+
+// runWorkloadOp runs a single operation and returns number of transferred bytes.
+func runWorkloadOp(client *Client, r *rand.Rand, op string, b *workloadBlob) int64 {
+	switch op {
+	case opRead:
+		l, err := client.Download(b.size, b.hash)
+		recordLatency("DOWNLOAD", b.size, l)
+		if isCorruption(err) {
+			atomic.AddInt64(&corruptedDownloads, 1)
+			recordError("DOWNLOAD")
+			log.Printf("WORKLOAD  %s", err)
+		} else {
+			noError(err)
+		}
+		return b.size
+
+	case opWrite:
+		extraBytes := make([]byte, 16)
+		_, err := r.Read(extraBytes)
+		noError(err)
+		open := func() (io.ReadCloser, error) {
+			f, err := b.open()
+			if err != nil {
+				return nil, err
+			}
+			return readCloser{io.MultiReader(f, bytes.NewReader(extraBytes)), f}, nil
+		}
+		size := b.size + int64(len(extraBytes))
+		l, err := client.Upload(open, size, extendHash(b.hashState, extraBytes))
+		if err == errUploadCancelled {
+			return 0
+		}
+		noError(err)
+		recordLatency("UPLOAD", size, l)
+		return size
+
+	case opMiss:
+		// Random hash, which is not expected to exist, size of a popular blob
+		l, err := client.Download(b.size, randomHash(r))
+		recordLatency("MISS", b.size, l)
+		if status.Code(err) != codes.NotFound {
+			log.Fatalf("Expected not found error for missing blob, got: %v", err)
+		}
+		return 0
+	}
+	panic("unknown operation: " + op)
+}
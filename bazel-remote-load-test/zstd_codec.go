@@ -0,0 +1,147 @@
+package main
+
+import (
+	zstdcgo "github.com/DataDog/zstd"
+	"github.com/klauspost/compress/zstd"
+	"google.golang.org/genproto/googleapis/bytestream"
+	"io"
+	"log"
+	"sync"
+	"time"
+)
+import "flag"
+
+var compressedBlobs = flag.Bool("compressed_blobs", false, "Use compressed-blobs/zstd resources, compressing uploads and decompressing downloads on the client")
+var zstdImpl = flag.String("zstd_implementation", "go", "Client zstd implementation for -compressed_blobs: go or cgo")
+
+// Streaming encoders and decoders are not thread safe, so they are pooled for use by parallel clients
+var zstdEncoders = sync.Pool{New: func() interface{} {
+	e, err := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+	noError(err)
+	return e
+}}
+
+// zstdDecoderPool keeps idle decoders up to the number of requests which can run at the same time. Decoders run
+// goroutines until they are closed, so unlike sync.Pool, which drops entries on GC, it closes decoders it drops.
+type zstdDecoderPool struct {
+	once sync.Once
+	idle chan *zstd.Decoder
+}
+
+var zstdDecoders zstdDecoderPool
+
+func (p *zstdDecoderPool) Get() *zstd.Decoder {
+	p.once.Do(func() {
+		p.idle = make(chan *zstd.Decoder, *parallel+*maxInflight)
+	})
+	select {
+	case d := <-p.idle:
+		return d
+	default:
+		d, err := zstd.NewReader(nil, zstd.WithDecoderConcurrency(1))
+		noError(err)
+		return d
+	}
+}
+
+func (p *zstdDecoderPool) Put(d *zstd.Decoder) {
+	select {
+	case p.idle <- d:
+	default:
+		d.Close()
+	}
+}
+
+// closeZstdDecoders closes idle decoders at shutdown.
+func closeZstdDecoders() {
+	for {
+		select {
+		case d := <-zstdDecoders.idle:
+			d.Close()
+		default:
+			return
+		}
+	}
+}
+
+func checkZstdImpl() {
+	if *zstdImpl != "go" && *zstdImpl != "cgo" {
+		log.Fatalf("Unknown zstd implementation: %s", *zstdImpl)
+	}
+}
+
+// zstdCompress compresses all data from r to w.
+func zstdCompress(w io.Writer, r io.Reader) error {
+	if *zstdImpl == "cgo" {
+		zw := zstdcgo.NewWriter(w)
+		if _, err := io.Copy(zw, r); err != nil {
+			_ = zw.Close()
+			return err
+		}
+		return zw.Close()
+	}
+
+	e := zstdEncoders.Get().(*zstd.Encoder)
+	defer zstdEncoders.Put(e)
+	e.Reset(w)
+	if _, err := io.Copy(e, r); err != nil {
+		_ = e.Close()
+		return err
+	}
+	return e.Close()
+}
+
+// zstdDecompress decompresses all data from r to w.
+func zstdDecompress(w io.Writer, r io.Reader) error {
+	if *zstdImpl == "cgo" {
+		zr := zstdcgo.NewReader(r)
+		if _, err := io.Copy(w, zr); err != nil {
+			_ = zr.Close()
+			return err
+		}
+		return zr.Close()
+	}
+
+	d := zstdDecoders.Get()
+	defer zstdDecoders.Put(d)
+	if err := d.Reset(r); err != nil {
+		return err
+	}
+	_, err := io.Copy(w, d)
+	return err
+}
+
+// readStreamReader provides data received from the ByteStream Read call as io.Reader.
+type readStreamReader struct {
+	stream bytestream.ByteStream_ReadClient
+	buf    []byte
+	// Time when the first response was received
+	first time.Time
+}
+
+func (r *readStreamReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		resp, err := r.stream.Recv()
+		if r.first.IsZero() {
+			r.first = time.Now()
+		}
+		if err != nil {
+			return 0, err
+		}
+		r.buf = resp.GetData()
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+type wcounter struct {
+	n   int64
+	out io.Writer
+}
+
+func (w *wcounter) Write(p []byte) (n int, err error) {
+	n, err = w.out.Write(p)
+	w.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestZstdDecodersAreReused(t *testing.T) {
+	data, _ := testBlob(100 << 10)
+	var compressed bytes.Buffer
+	if err := zstdCompress(&compressed, bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+
+	decode := func() {
+		var out bytes.Buffer
+		if err := zstdDecompress(&out, bytes.NewReader(compressed.Bytes())); err != nil {
+			t.Fatal(err)
+		}
+		// Same pool is used by gRPC message compression
+		r, err := grpcZstdCompressor{}.Decompress(bytes.NewReader(compressed.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(out.Bytes(), data) || !bytes.Equal(got, data) {
+			t.Fatal("decompressed data does not match")
+		}
+		// sync.Pool drops entries on the second GC
+		runtime.GC()
+		runtime.GC()
+	}
+
+	decode()
+	// Goroutines of finished streams may take a moment to exit
+	time.Sleep(100 * time.Millisecond)
+	before := runtime.NumGoroutine()
+	for i := 0; i < 20; i++ {
+		decode()
+	}
+	time.Sleep(100 * time.Millisecond)
+	if after := runtime.NumGoroutine(); after > before {
+		t.Fatalf("goroutines grew from %d to %d", before, after)
+	}
+}
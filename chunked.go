@@ -0,0 +1,126 @@
+package main
+
+import (
+	"github.com/dustin/go-humanize"
+	"github.com/klauspost/compress/zstd"
+	"io"
+)
+
+// ChunkedEncoder splits input into chunks of ChunkSize bytes, which are compressed in parallel as independent frames.
+// Concatenated frames are a valid zstd stream, so the output can be decompressed by any decoder.
+type ChunkedEncoder struct {
+	ChunkSize int
+}
+
+func (e ChunkedEncoder) String() string {
+	return "ZSTD CHUNKED " + humanize.IBytes(uint64(e.ChunkSize))
+}
+
+var zstdEncoderChunked *zstd.Encoder
+
+func (e ChunkedEncoder) NewWriter(w io.WriteCloser) io.WriteCloser {
+	// EncodeAll can be called concurrently, up to encoder concurrency at the same time
+	if zstdEncoderChunked == nil {
+		zstdEncoderChunked = newEncoder(zstd.WithEncoderConcurrency(*chunkConcurrency))
+	}
+	return NewChunkedWriter(w, zstdEncoderChunked, e.ChunkSize, *chunkConcurrency)
+}
+
+// ChunkedWriter compresses chunks in separate goroutines and writes frames to the underlying writer in input order.
+// Errors of the underlying writer are returned by Close, which does not close it.
+type ChunkedWriter struct {
+	w         io.Writer
+	enc       *zstd.Encoder
+	chunkSize int
+	buf       []byte
+
+	// Results of compression in input order, limits number of chunks in flight. nil marks the end of input.
+	pending chan chan []byte
+	// Buffers of chunks which were already compressed
+	free   chan []byte
+	done   chan error
+	err    error
+	closed bool
+}
+
+func NewChunkedWriter(w io.Writer, enc *zstd.Encoder, chunkSize int, concurrency int) *ChunkedWriter {
+	c := &ChunkedWriter{
+		w:         w,
+		enc:       enc,
+		chunkSize: chunkSize,
+		pending:   make(chan chan []byte, concurrency),
+		free:      make(chan []byte, concurrency+2),
+		done:      make(chan error, 1),
+	}
+	c.buf = c.getBuffer()
+	go c.writeFrames(c.pending)
+	return c
+}
+
+func (c *ChunkedWriter) getBuffer() []byte {
+	select {
+	case b := <-c.free:
+		return b[:0]
+	default:
+		return make([]byte, 0, c.chunkSize)
+	}
+}
+
+func (c *ChunkedWriter) writeFrames(pending chan chan []byte) {
+	var err error
+	for res := range pending {
+		if res == nil {
+			break
+		}
+		frame := <-res
+		if err == nil {
+			_, err = c.w.Write(frame)
+		}
+	}
+	c.done <- err
+}
+
+func (c *ChunkedWriter) flushChunk() {
+	if len(c.buf) == 0 {
+		return
+	}
+	res := make(chan []byte, 1)
+	c.pending <- res
+	go func(chunk []byte) {
+		res <- c.enc.EncodeAll(chunk, nil)
+		select {
+		case c.free <- chunk:
+		default:
+		}
+	}(c.buf)
+	c.buf = c.getBuffer()
+}
+
+func (c *ChunkedWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := c.chunkSize - len(c.buf)
+		if n > len(p) {
+			n = len(p)
+		}
+		c.buf = append(c.buf, p[:n]...)
+		p = p[n:]
+		written += n
+		if len(c.buf) == c.chunkSize {
+			c.flushChunk()
+		}
+	}
+	return written, nil
+}
+
+func (c *ChunkedWriter) Close() error {
+	if c.closed {
+		return c.err
+	}
+	c.closed = true
+	c.flushChunk()
+	// Builtin close is shadowed in this package
+	c.pending <- nil
+	c.err = <-c.done
+	return c.err
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"bytes"
+	"github.com/klauspost/compress/zstd"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+)
+
+func TestChunkedRoundTrip(t *testing.T) {
+	const chunkSize = 1 << 10
+	enc := newEncoder(zstd.WithEncoderConcurrency(2))
+	for _, size := range []int{0, 1, chunkSize, 3*chunkSize + 7} {
+		data := make([]byte, size)
+		rand.New(rand.NewSource(int64(size))).Read(data)
+
+		var compressed bytes.Buffer
+		w := NewChunkedWriter(&compressed, enc, chunkSize, 2)
+		// Writes which are not aligned to chunks
+		for p := data; len(p) > 0; {
+			n := 100
+			if n > len(p) {
+				n = len(p)
+			}
+			if _, err := w.Write(p[:n]); err != nil {
+				t.Fatalf("size %d: write: %s", size, err)
+			}
+			p = p[n:]
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("size %d: close: %s", size, err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("size %d: second close: %s", size, err)
+		}
+
+		got, err := ioutil.ReadAll(Decoder(ZstdDecoder).NewReader(&compressed))
+		if err != nil {
+			t.Fatalf("size %d: read: %s", size, err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Fatalf("size %d: got %d different bytes", size, len(got))
+		}
+	}
+}
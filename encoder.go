@@ -7,19 +7,26 @@ import (
 	"io"
 )
 
+// WriterFactory creates compressing writers, implemented by Encoder and parametrized encoders like ChunkedEncoder.
+type WriterFactory interface {
+	NewWriter(w io.WriteCloser) io.WriteCloser
+	String() string
+}
+
 type Encoder int
 
 const (
-	Identity = iota
+	Identity Encoder = iota
 	ZstdDefault
 	ZstdSpeed
 	ZstdCgoDefault
 	ZstdCgoSpeed
 	Gzip
+	ZstdSeekable
 )
 
 func (e Encoder) String() string {
-	return [...]string{"IDENTITY", "ZSTD DEFAULT", "ZSTD BEST_SPEED", "ZSTD CGO DEFAULT", "ZSTD CGO SPEED", "GZIP"}[e]
+	return [...]string{"IDENTITY", "ZSTD DEFAULT", "ZSTD BEST_SPEED", "ZSTD CGO DEFAULT", "ZSTD CGO SPEED", "GZIP", "ZSTD SEEKABLE"}[e]
 }
 
 var zstdEncoderDefault, zstdEncoderSpeedFastest *zstd.Encoder
@@ -54,6 +61,12 @@ func (e Encoder) NewWriter(w io.WriteCloser) io.WriteCloser {
 		return zstdcgo.NewWriterLevel(w, zstdcgo.DefaultCompression)
 	case Gzip:
 		return gzip.NewWriter(w)
+	case ZstdSeekable:
+		// Frames are compressed with EncodeAll, which can share the encoder with streaming
+		if zstdEncoderDefault == nil {
+			zstdEncoderDefault = newEncoder()
+		}
+		return NewSeekableWriter(w, zstdEncoderDefault, *seekableFrameSize)
 	default:
 		panic(e)
 	}
@@ -5,8 +5,11 @@ import (
 	"github.com/dustin/go-humanize"
 	"io"
 	"io/ioutil"
+	"log"
 	"os"
 	"path/filepath"
+	"runtime"
+	"strings"
 	"syscall"
 	"time"
 )
@@ -18,6 +21,11 @@ var tmpDir = flag.String("tmp_dir", "/tmp", "Temporary directory to compress and
 var maxFiles = flag.Int("max_files", 0, "Maximum number of files to process - 0 for all")
 var includeStime = flag.Bool("include_stime", false, "Include system time")
 var useWallTime = flag.Bool("use_walltime", false, "Use walltime instead of CPU time")
+var seekableFrameSize = flag.Int("seekable_frame_size", 1<<20, "Uncompressed size of independent frames in ZSTD SEEKABLE format")
+var randomReads = flag.Int("random_reads", 0, "Number of random range reads per file to compare seekable format with full decompression - 0 to skip")
+var randomReadSize = flag.Int("random_read_size", 64<<10, "Maximum size of each random range read")
+var chunkSizes = flag.String("chunk_sizes", "", "Comma separated chunk sizes (e.g. 1MiB,16MiB) of ZSTD CHUNKED compressors, which compress chunks as independent frames in parallel")
+var chunkConcurrency = flag.Int("chunk_concurrency", runtime.GOMAXPROCS(0), "Number of chunks compressed in parallel by ZSTD CHUNKED compressors")
 
 type FileData struct {
 	Path string
@@ -85,7 +93,7 @@ func getCpuTime() time.Duration {
 	return time.Duration(sec*1000000000 + usec*1000)
 }
 
-func compressFiles(files []FileData, encoder Encoder, decoder Decoder) (inSize, outSize int64, encTime, decTime time.Duration) {
+func compressFiles(files []FileData, encoder WriterFactory, decoder Decoder) (inSize, outSize int64, encTime, decTime time.Duration) {
 	toProcess := len(files)
 	if *maxFiles > 0 && *maxFiles < toProcess {
 		toProcess = *maxFiles
@@ -150,10 +158,28 @@ func compressFiles(files []FileData, encoder Encoder, decoder Decoder) (inSize,
 }
 
 type Compressor struct {
-	e Encoder
+	e WriterFactory
 	d Decoder
 }
 
+func getChunkedCompressors() []Compressor {
+	var compressors []Compressor
+	if *chunkSizes == "" {
+		return compressors
+	}
+	for _, s := range strings.Split(*chunkSizes, ",") {
+		size, err := humanize.ParseBytes(s)
+		if err != nil {
+			panic(err)
+		}
+		if size == 0 {
+			log.Fatalf("Invalid chunk size: %s, must be greater than 0", s)
+		}
+		compressors = append(compressors, Compressor{ChunkedEncoder{int(size)}, ZstdDecoder})
+	}
+	return compressors
+}
+
 func processFiles(files []FileData) {
 	var totalSize int64
 	for _, f := range files {
@@ -171,23 +197,25 @@ func processFiles(files []FileData) {
 		{ZstdSpeed, ZstdDecoder},
 		{ZstdCgoDefault, ZstdCgoDecoder},
 		{ZstdCgoSpeed, ZstdCgoDecoder},
+		{ZstdSeekable, ZstdDecoder},
 		//{ Gzip, GzipDecoder },
 	}
+	compressors = append(compressors, getChunkedCompressors()...)
 
 	fmt.Printf(
 		"%20s  %10s %10s %6s %14s %14s %10s %10s\n",
 		"compressor", "inSize", "outSize", "ratio", "enc_time", "dec_time", "enc_speed", "dec_speed")
 
+	ratios := make(map[string]float64)
 	for _, c := range compressors {
 		fmt.Printf("%20s  ", c.e)
 		inSize, outSize, encTime, decTime := compressFiles(files, c.e, c.d)
 		ratio := float64(outSize) / float64(inSize)
+		ratios[c.e.String()] = ratio
 
 		encSpeed := float64(inSize) / encTime.Seconds()
 		decSpeed := float64(inSize) / decTime.Seconds()
 
-		encTime.String()
-
 		fmt.Printf(
 			"%10s %10s %6.2f %14s %14s %10s %10s\n",
 			humanize.Bytes(uint64(inSize)),
@@ -198,10 +226,26 @@ func processFiles(files []FileData) {
 			humanize.Bytes(uint64(encSpeed)) + "/s",
 			humanize.Bytes(uint64(decSpeed)) + "/s")
 	}
+
+	if *chunkSizes != "" {
+		// Chunks are compressed with default level, so it is the reference for the ratio loss
+		fmt.Printf("\n%20s  %10s\n", "compressor", "ratio_loss")
+		for _, c := range getChunkedCompressors() {
+			fmt.Printf("%20s  %10.2f\n", c.e, (ratios[c.e.String()]-ratios[ZstdDefault.String()])*100)
+		}
+	}
 }
 
 func main() {
 	flag.Parse()
+	if *seekableFrameSize <= 0 || *seekableFrameSize > maxSeekableFrameSize {
+		log.Fatalf("Invalid seekable frame size: %d, must be from 1 to %d", *seekableFrameSize, maxSeekableFrameSize)
+	}
+	if *chunkConcurrency <= 0 {
+		log.Fatalf("Invalid chunk concurrency: %d, must be greater than 0", *chunkConcurrency)
+	}
+	// Chunk sizes are checked before scanning files
+	getChunkedCompressors()
 
 	root, err := filepath.Abs(*rootDir)
 	if err != nil {
@@ -215,4 +259,7 @@ func main() {
 		return
 	}
 	processFiles(files)
+	if *randomReads > 0 {
+		randomAccessBenchmark(files)
+	}
 }
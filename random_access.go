@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/dustin/go-humanize"
+	"github.com/klauspost/compress/zstd"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+type readRange struct {
+	off   int64
+	limit int64
+}
+
+func compressToTemp(path string, encoder Encoder) string {
+	f, err := os.OpenFile(path, os.O_RDONLY, 0)
+	if err != nil {
+		panic(err)
+	}
+	defer close(f)
+	compressed, err := ioutil.TempFile(*tmpDir, filepath.Base(path)+"_zstd_*")
+	if err != nil {
+		panic(err)
+	}
+	defer close(compressed)
+
+	w := encoder.NewWriter(compressed)
+	if _, err = io.Copy(w, f); err != nil {
+		panic(err)
+	}
+	if w != compressed {
+		close(w)
+	}
+	return compressed.Name()
+}
+
+func getRandomRanges(r *rand.Rand, size int64) []readRange {
+	ranges := make([]readRange, *randomReads)
+	for i := range ranges {
+		off := r.Int63n(size)
+		limit := int64(*randomReadSize)
+		if off+limit > size {
+			limit = size - off
+		}
+		ranges[i] = readRange{off, limit}
+	}
+	return ranges
+}
+
+// Reads ranges from seekable file decompressing only frames which are needed.
+func readSeekable(path string, ranges []readRange, dec *zstd.Decoder, out [][]byte) {
+	f, err := os.OpenFile(path, os.O_RDONLY, 0)
+	if err != nil {
+		panic(err)
+	}
+	defer close(f)
+	s, err := NewSeekableReader(f, getSize(path), dec)
+	if err != nil {
+		panic(err)
+	}
+	for i, r := range ranges {
+		if _, err := s.ReadAt(out[i][:r.limit], r.off); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// Reads ranges from a plain zstd stream, which needs to be decompressed from the start for every range.
+func readFromStart(path string, ranges []readRange, decoder Decoder, out [][]byte) {
+	for i, r := range ranges {
+		f, err := os.OpenFile(path, os.O_RDONLY, 0)
+		if err != nil {
+			panic(err)
+		}
+		d := decoder.NewReader(f)
+		if _, err := io.CopyN(ioutil.Discard, d, r.off); err != nil {
+			panic(err)
+		}
+		if _, err := io.ReadFull(d, out[i][:r.limit]); err != nil {
+			panic(err)
+		}
+		close(f)
+	}
+}
+
+func verifyRanges(path string, ranges []readRange, out [][]byte) {
+	f, err := os.OpenFile(path, os.O_RDONLY, 0)
+	if err != nil {
+		panic(err)
+	}
+	defer close(f)
+	expected := make([]byte, *randomReadSize)
+	for i, r := range ranges {
+		if _, err := f.ReadAt(expected[:r.limit], r.off); err != nil && err != io.EOF {
+			panic(err)
+		}
+		if !bytes.Equal(expected[:r.limit], out[i][:r.limit]) {
+			panic(fmt.Sprintf("Invalid data read from %s at offset %d, limit %d", path, r.off, r.limit))
+		}
+	}
+}
+
+func randomAccessBenchmark(files []FileData) {
+	toProcess := len(files)
+	if *maxFiles > 0 && *maxFiles < toProcess {
+		toProcess = *maxFiles
+	}
+
+	seekableDecoder, err := zstd.NewReader(nil, zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		panic(err)
+	}
+	// Fixed seed, so every run reads the same ranges
+	random := rand.New(rand.NewSource(1))
+	out := make([][]byte, *randomReads)
+	for i := range out {
+		out[i] = make([]byte, *randomReadSize)
+	}
+
+	var inSize, seekableSize, plainSize, readSize int64
+	var seekableTime, plainTime time.Duration
+	var numReads int
+	for j := 0; j < *iterations; j++ {
+		for i := 0; i < toProcess; i++ {
+			size := getSize(files[i].Path)
+			if size == 0 {
+				continue
+			}
+			inSize += size
+			ranges := getRandomRanges(random, size)
+			for _, r := range ranges {
+				readSize += r.limit
+			}
+			numReads += len(ranges)
+
+			seekable := compressToTemp(files[i].Path, ZstdSeekable)
+			seekableSize += getSize(seekable)
+			start := getCpuTime()
+			readSeekable(seekable, ranges, seekableDecoder, out)
+			seekableTime += getCpuTime() - start
+			verifyRanges(files[i].Path, ranges, out)
+			remove(seekable)
+
+			plain := compressToTemp(files[i].Path, ZstdDefault)
+			plainSize += getSize(plain)
+			start = getCpuTime()
+			readFromStart(plain, ranges, ZstdDecoder, out)
+			plainTime += getCpuTime() - start
+			verifyRanges(files[i].Path, ranges, out)
+			remove(plain)
+		}
+	}
+
+	if numReads == 0 {
+		return
+	}
+	fmt.Printf(
+		"\nRandom reads: %s, read size: %s, total read: %s\n",
+		humanize.Comma(int64(numReads)), humanize.Bytes(uint64(*randomReadSize)), humanize.Bytes(uint64(readSize)))
+	fmt.Printf(
+		"%20s  %10s %10s %6s %14s %14s %10s\n",
+		"compressor", "inSize", "outSize", "ratio", "read_time", "per_read", "read_speed")
+	for _, r := range []struct {
+		e    Encoder
+		size int64
+		time time.Duration
+	}{
+		{ZstdSeekable, seekableSize, seekableTime},
+		{ZstdDefault, plainSize, plainTime},
+	} {
+		fmt.Printf(
+			"%20s  %10s %10s %6.2f %14s %14s %10s\n",
+			r.e,
+			humanize.Bytes(uint64(inSize)),
+			humanize.Bytes(uint64(r.size)),
+			float64(r.size)/float64(inSize)*100,
+			r.time,
+			r.time/time.Duration(numReads),
+			humanize.Bytes(uint64(float64(readSize)/r.time.Seconds()))+"/s")
+	}
+}
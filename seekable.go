@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/klauspost/compress/zstd"
+	"io"
+	"sort"
+)
+
+// Seekable format: https://github.com/facebook/zstd/blob/dev/contrib/seekable_format/zstd_seekable_compression_format.md
+// Data is compressed as independent frames, followed by a skippable frame with a seek table, so the result can
+// be decompressed by any zstd decoder, but also random ranges can be read by decompressing only the frames needed.
+const (
+	seekTableMagic      = 0x184D2A5E
+	seekableMagic       = 0x8F92EAB1
+	seekTableFooterSize = 9
+	seekTableEntrySize  = 8
+	// Largest frame whose compressed size, which can exceed the uncompressed one, still fits the uint32 entry fields
+	maxSeekableFrameSize = 1 << 31
+)
+
+type seekTableEntry struct {
+	compressedSize   uint32
+	decompressedSize uint32
+}
+
+// SeekableWriter compresses data written to it as frames of frameSize uncompressed bytes and writes seek table on Close.
+// Close does not close the underlying writer.
+type SeekableWriter struct {
+	w         io.Writer
+	enc       *zstd.Encoder
+	frameSize int
+	buf       []byte
+	frame     []byte
+	entries   []seekTableEntry
+}
+
+func NewSeekableWriter(w io.Writer, enc *zstd.Encoder, frameSize int) *SeekableWriter {
+	return &SeekableWriter{w: w, enc: enc, frameSize: frameSize, buf: make([]byte, 0, frameSize)}
+}
+
+func (s *SeekableWriter) flushFrame() error {
+	if len(s.buf) == 0 {
+		return nil
+	}
+	s.frame = s.enc.EncodeAll(s.buf, s.frame[:0])
+	if _, err := s.w.Write(s.frame); err != nil {
+		return err
+	}
+	s.entries = append(s.entries, seekTableEntry{
+		compressedSize:   uint32(len(s.frame)),
+		decompressedSize: uint32(len(s.buf)),
+	})
+	s.buf = s.buf[:0]
+	return nil
+}
+
+func (s *SeekableWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := s.frameSize - len(s.buf)
+		if n > len(p) {
+			n = len(p)
+		}
+		s.buf = append(s.buf, p[:n]...)
+		p = p[n:]
+		written += n
+		if len(s.buf) == s.frameSize {
+			if err := s.flushFrame(); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+func (s *SeekableWriter) Close() error {
+	if err := s.flushFrame(); err != nil {
+		return err
+	}
+
+	tableSize := len(s.entries)*seekTableEntrySize + seekTableFooterSize
+	table := make([]byte, 8, 8+tableSize)
+	binary.LittleEndian.PutUint32(table[0:], seekTableMagic)
+	binary.LittleEndian.PutUint32(table[4:], uint32(tableSize))
+	for _, e := range s.entries {
+		table = appendUint32(table, e.compressedSize)
+		table = appendUint32(table, e.decompressedSize)
+	}
+	table = appendUint32(table, uint32(len(s.entries)))
+	// Seek table descriptor, checksums are not stored
+	table = append(table, 0)
+	table = appendUint32(table, seekableMagic)
+
+	s.entries = s.entries[:0]
+	_, err := s.w.Write(table)
+	return err
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	return append(b, byte(v), byte(v>>8), byte(v>>16), byte(v>>24))
+}
+
+// SeekableReader provides random access to uncompressed data of a seekable zstd stream.
+type SeekableReader struct {
+	r   io.ReaderAt
+	dec *zstd.Decoder
+
+	// Offsets of frames, in compressed and uncompressed data, with extra element at the end with total sizes
+	compressedOffsets   []int64
+	decompressedOffsets []int64
+
+	// Last decoded frame, so sequential small reads do not decode the same frame again
+	cachedFrame int
+	cached      []byte
+	compressed  []byte
+}
+
+func NewSeekableReader(r io.ReaderAt, size int64, dec *zstd.Decoder) (*SeekableReader, error) {
+	var footer [seekTableFooterSize]byte
+	if size < seekTableFooterSize+8 {
+		return nil, errors.New("seekable: input too small")
+	}
+	if _, err := r.ReadAt(footer[:], size-seekTableFooterSize); err != nil {
+		return nil, err
+	}
+	if binary.LittleEndian.Uint32(footer[5:]) != seekableMagic {
+		return nil, errors.New("seekable: seekable magic number not found")
+	}
+	if footer[4]&0x80 != 0 {
+		return nil, errors.New("seekable: seek table with checksums is not supported")
+	}
+	numFrames := int64(binary.LittleEndian.Uint32(footer[0:]))
+	tableSize := numFrames*seekTableEntrySize + seekTableFooterSize
+	if size < tableSize+8 {
+		return nil, errors.New("seekable: seek table larger than input")
+	}
+
+	table := make([]byte, 8+tableSize)
+	if _, err := r.ReadAt(table, size-int64(len(table))); err != nil {
+		return nil, err
+	}
+	if binary.LittleEndian.Uint32(table[0:]) != seekTableMagic ||
+		int64(binary.LittleEndian.Uint32(table[4:])) != tableSize {
+		return nil, errors.New("seekable: invalid seek table header")
+	}
+
+	s := &SeekableReader{
+		r:                   r,
+		dec:                 dec,
+		compressedOffsets:   make([]int64, numFrames+1),
+		decompressedOffsets: make([]int64, numFrames+1),
+		cachedFrame:         -1,
+	}
+	for i := int64(0); i < numFrames; i++ {
+		e := table[8+i*seekTableEntrySize:]
+		s.compressedOffsets[i+1] = s.compressedOffsets[i] + int64(binary.LittleEndian.Uint32(e[0:]))
+		s.decompressedOffsets[i+1] = s.decompressedOffsets[i] + int64(binary.LittleEndian.Uint32(e[4:]))
+	}
+	if s.compressedOffsets[numFrames]+int64(len(table)) != size {
+		return nil, fmt.Errorf("seekable: frames size %d does not match input size %d",
+			s.compressedOffsets[numFrames]+int64(len(table)), size)
+	}
+	return s, nil
+}
+
+// Size returns size of the uncompressed data.
+func (s *SeekableReader) Size() int64 {
+	return s.decompressedOffsets[len(s.decompressedOffsets)-1]
+}
+
+func (s *SeekableReader) readFrame(i int) ([]byte, error) {
+	if i == s.cachedFrame {
+		return s.cached, nil
+	}
+	start, end := s.compressedOffsets[i], s.compressedOffsets[i+1]
+	if int64(cap(s.compressed)) < end-start {
+		s.compressed = make([]byte, end-start)
+	}
+	s.compressed = s.compressed[:end-start]
+	if _, err := s.r.ReadAt(s.compressed, start); err != nil {
+		return nil, err
+	}
+
+	var err error
+	s.cachedFrame = -1
+	s.cached, err = s.dec.DecodeAll(s.compressed, s.cached[:0])
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(s.cached)) != s.decompressedOffsets[i+1]-s.decompressedOffsets[i] {
+		return nil, fmt.Errorf("seekable: frame %d decompressed to %d bytes, expected %d",
+			i, len(s.cached), s.decompressedOffsets[i+1]-s.decompressedOffsets[i])
+	}
+	s.cachedFrame = i
+	return s.cached, nil
+}
+
+// ReadAt reads uncompressed data at the given offset, decompressing only frames overlapping with the range.
+func (s *SeekableReader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("seekable: negative offset")
+	}
+	read := 0
+	for len(p) > 0 && off < s.Size() {
+		// First frame which ends after off
+		i := sort.Search(len(s.decompressedOffsets)-1, func(i int) bool {
+			return s.decompressedOffsets[i+1] > off
+		})
+		frame, err := s.readFrame(i)
+		if err != nil {
+			return read, err
+		}
+		n := copy(p, frame[off-s.decompressedOffsets[i]:])
+		p = p[n:]
+		off += int64(n)
+		read += n
+	}
+	if len(p) > 0 {
+		return read, io.EOF
+	}
+	return read, nil
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	dzstd "github.com/DataDog/zstd"
+	"github.com/klauspost/compress/zstd"
+	vzstd "github.com/valyala/gozstd"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"time"
+)
+import "flag"
+
+var compareApis = flag.Bool("compare_apis", false, "Compare stateless (EncodeAll/Compress) and streaming APIs of all zstd implementations on the input file read to memory")
+
+// apiCodec compresses src into dst and decompresses it back using one API of one implementation.
+// Both functions get a zero length, preallocated dst and return the (possibly grown) result.
+type apiCodec struct {
+	name       string
+	compress   func(dst, src []byte) []byte
+	decompress func(dst, src []byte) []byte
+}
+
+// cgoLevel maps klauspost encoder level to roughly equivalent zstd level, as documented in klauspost/compress.
+func cgoLevel(l zstd.EncoderLevel) int {
+	switch l {
+	case zstd.SpeedFastest:
+		return 1
+	case zstd.SpeedDefault:
+		return 3
+	case zstd.SpeedBetterCompression:
+		return 7
+	case zstd.SpeedBestCompression:
+		return 11
+	default:
+		log.Fatalf("Invalid level: %d, must be from %d to %d", l, zstd.SpeedFastest, zstd.SpeedBestCompression)
+		return 0
+	}
+}
+
+func noError(err error) {
+	if err != nil {
+		panic(err)
+	}
+}
+
+func getApiCodecs(l zstd.EncoderLevel) []apiCodec {
+	enc, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(l))
+	noError(err)
+	dec, err := zstd.NewReader(nil)
+	noError(err)
+	level := cgoLevel(l)
+
+	return []apiCodec{
+		{
+			name: "zskp EncodeAll",
+			compress: func(dst, src []byte) []byte {
+				return enc.EncodeAll(src, dst)
+			},
+			decompress: func(dst, src []byte) []byte {
+				out, err := dec.DecodeAll(src, dst)
+				noError(err)
+				return out
+			},
+		},
+		{
+			name: "zskp stream",
+			compress: func(dst, src []byte) []byte {
+				b := bytes.NewBuffer(dst)
+				enc.Reset(b)
+				_, err := io.Copy(enc, bytes.NewReader(src))
+				noError(err)
+				noError(enc.Close())
+				return b.Bytes()
+			},
+			decompress: func(dst, src []byte) []byte {
+				b := bytes.NewBuffer(dst)
+				noError(dec.Reset(bytes.NewReader(src)))
+				_, err := io.Copy(b, dec)
+				noError(err)
+				return b.Bytes()
+			},
+		},
+		{
+			name: "dzstd Compress",
+			compress: func(dst, src []byte) []byte {
+				out, err := dzstd.CompressLevel(dst, src, level)
+				noError(err)
+				return out
+			},
+			decompress: func(dst, src []byte) []byte {
+				// Decompress uses dst only if it has enough length, not capacity
+				out, err := dzstd.Decompress(dst[:cap(dst)], src)
+				noError(err)
+				return out
+			},
+		},
+		{
+			name: "dzstd stream",
+			compress: func(dst, src []byte) []byte {
+				b := bytes.NewBuffer(dst)
+				w := dzstd.NewWriterLevel(b, level)
+				_, err := io.Copy(w, bytes.NewReader(src))
+				noError(err)
+				noError(w.Close())
+				return b.Bytes()
+			},
+			decompress: func(dst, src []byte) []byte {
+				b := bytes.NewBuffer(dst)
+				r := dzstd.NewReader(bytes.NewReader(src))
+				_, err := io.Copy(b, r)
+				noError(err)
+				noError(r.Close())
+				return b.Bytes()
+			},
+		},
+		{
+			name: "zstd Compress",
+			compress: func(dst, src []byte) []byte {
+				return vzstd.CompressLevel(dst, src, level)
+			},
+			decompress: func(dst, src []byte) []byte {
+				out, err := vzstd.Decompress(dst, src)
+				noError(err)
+				return out
+			},
+		},
+		{
+			name: "zstd stream",
+			compress: func(dst, src []byte) []byte {
+				b := bytes.NewBuffer(dst)
+				w := vzstd.NewWriterLevel(b, level)
+				_, err := io.Copy(w, bytes.NewReader(src))
+				noError(err)
+				noError(w.Close())
+				w.Release()
+				return b.Bytes()
+			},
+			decompress: func(dst, src []byte) []byte {
+				b := bytes.NewBuffer(dst)
+				r := vzstd.NewReader(bytes.NewReader(src))
+				_, err := io.Copy(b, r)
+				noError(err)
+				r.Release()
+				return b.Bytes()
+			},
+		},
+	}
+}
+
+func runCompareApis(in *os.File, l zstd.EncoderLevel) {
+	src, err := ioutil.ReadAll(in)
+	noError(err)
+	noError(in.Close())
+
+	// Same buffers are reused for every codec, so none of them is favoured by allocations.
+	// DataDog CompressLevel allocates unless dst can hold the compress bound.
+	cmpBuf := make([]byte, 0, dzstd.CompressBound(len(src)))
+	decBuf := make([]byte, 0, len(src))
+
+	fmt.Printf(
+		"%16s %10s %10s %6s %14s %14s %10s %10s\n",
+		"api", "inSize", "outSize", "ratio", "enc_time", "dec_time", "enc_MiB/s", "dec_MiB/s")
+
+	for _, c := range getApiCodecs(l) {
+		start := time.Now()
+		compressed := c.compress(cmpBuf[:0], src)
+		encTime := time.Now().Sub(start)
+
+		start = time.Now()
+		decompressed := c.decompress(decBuf[:0], compressed)
+		decTime := time.Now().Sub(start)
+
+		if !bytes.Equal(src, decompressed) {
+			panic(fmt.Sprintf("%s: round trip mismatch, got %d bytes, expected %d", c.name, len(decompressed), len(src)))
+		}
+
+		fmt.Printf(
+			"%16s %10d %10d %6.2f %14s %14s %10.0f %10.0f\n",
+			c.name,
+			len(src),
+			len(compressed),
+			float64(len(compressed))/float64(len(src))*100,
+			encTime,
+			decTime,
+			float64(len(src))/(1<<20)/encTime.Seconds(),
+			float64(len(src))/(1<<20)/decTime.Seconds())
+	}
+}
@@ -2,4 +2,8 @@ module simple-zstd-demo
 
 go 1.17
 
-require github.com/klauspost/compress v1.13.6
+require (
+	github.com/DataDog/zstd v1.4.8
+	github.com/klauspost/compress v1.13.6
+	github.com/valyala/gozstd v1.13.0
+)
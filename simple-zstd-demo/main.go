@@ -2,73 +2,248 @@ package main
 
 import (
 	"fmt"
+	dzstd "github.com/DataDog/zstd"
 	"github.com/klauspost/compress/zstd"
 	"io"
-	"io/ioutil"
+	"log"
 	"os"
+	"strings"
 	"time"
 )
 import "flag"
 
-var inFile = flag.String("in", "", "Input file to compress")
-var outFile = flag.String("out", "", "Output file")
+var inFile = flag.String("in", "", "Input file, '-' for stdin. More input files can be given as arguments")
+var outFile = flag.String("out", "", "Output file, '-' for stdout. Defaults to input file with .zst suffix added (or removed with -d), or stdout for stdin")
 var level = flag.Int("level", int(zstd.SpeedDefault), "Compression level")
-var encodeAll = flag.Bool("encode_all", false, "Instead of encoding to output file, use EncodeAll on bytes read to memory")
+var decompressMode = flag.Bool("d", false, "Decompress instead of compress")
+var force = flag.Bool("f", false, "Overwrite existing output files")
+var impl = flag.String("impl", "klauspost", "Implementation to use: klauspost or cgo")
+var checksum = flag.Bool("checksum", true, "Write frame checksum when compressing (not supported by cgo implementation)")
+var encodeAll = flag.Bool("encode_all", false, "Alias of -compare_apis, which also measures EncodeAll on bytes read to memory")
+var contentSize = flag.Bool("content_size", true, "Write content size to the frame header when input size is known. For cgo implementation only inputs up to -cgo_max_in_memory, which are compressed in memory")
+var cgoMaxInMemory = flag.Int64("cgo_max_in_memory", 64<<20, "Largest input compressed in memory by cgo implementation to write its content size, larger inputs are streamed without it")
 
-func main() {
-	flag.Parse()
+const suffix = ".zst"
 
-	in, err := os.OpenFile(*inFile, os.O_RDONLY, 0)
-	if err != nil {
-		panic(err)
+var enc *zstd.Encoder
+var dec *zstd.Decoder
+
+type wcounter struct {
+	n   int64
+	out io.Writer
+}
+
+func (w *wcounter) Write(p []byte) (n int, err error) {
+	n, err = w.out.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+
+type rcounter struct {
+	n  int64
+	in io.Reader
+}
+
+func (r *rcounter) Read(p []byte) (n int, err error) {
+	n, err = r.in.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+func isFlagSet(name string) (set bool) {
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return
+}
+
+func getOutName(in string) string {
+	if *outFile != "" {
+		return *outFile
+	}
+	if in == "-" {
+		return "-"
+	}
+	if !*decompressMode {
+		return in + suffix
 	}
+	if !strings.HasSuffix(in, suffix) {
+		log.Fatalf("%s: unknown suffix, expected %s or -out", in, suffix)
+	}
+	return strings.TrimSuffix(in, suffix)
+}
 
-	stat, err := in.Stat()
-	if err != nil {
-		panic(err)
+func openIn(name string) (f *os.File, size int64) {
+	if name == "-" {
+		return os.Stdin, -1
+	}
+	f, err := os.OpenFile(name, os.O_RDONLY, 0)
+	noError(err)
+	stat, err := f.Stat()
+	noError(err)
+	if !stat.Mode().IsRegular() {
+		return f, -1
 	}
-	inSize := stat.Size()
+	return f, stat.Size()
+}
 
-	enc, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.EncoderLevel(*level)))
-	if err != nil {
-		panic(err)
+func openOut(name string) *os.File {
+	if name == "-" {
+		return os.Stdout
+	}
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if !*force {
+		flags |= os.O_EXCL
+	}
+	f, err := os.OpenFile(name, flags, 0644)
+	if os.IsExist(err) {
+		log.Fatalf("%s: already exists, use -f to overwrite", name)
 	}
+	noError(err)
+	return f
+}
 
-	var duration time.Duration
-	if *encodeAll {
-		bytes, err := ioutil.ReadAll(in)
-		if err != nil {
-			panic(err)
+func compress(in io.Reader, inSize int64, out io.Writer) error {
+	if *impl == "cgo" {
+		l := cgoLevel(zstd.EncoderLevel(*level))
+		if *contentSize && inSize >= 0 && inSize <= *cgoMaxInMemory {
+			// Streaming cgo writer does not know the size upfront, stateless API writes it
+			src := make([]byte, inSize)
+			if _, err := io.ReadFull(in, src); err != nil {
+				return err
+			}
+			dst, err := dzstd.CompressLevel(nil, src, l)
+			if err != nil {
+				return err
+			}
+			_, err = out.Write(dst)
+			return err
 		}
-		start := time.Now()
-		enc.EncodeAll(bytes, make([]byte, 0, len(bytes)))
-		duration = time.Now().Sub(start)
-	} else {
-		out, err := os.OpenFile(*outFile, os.O_WRONLY|os.O_CREATE, 0)
-		if err != nil {
-			panic(err)
+		w := dzstd.NewWriterLevel(out, l)
+		if _, err := io.Copy(w, in); err != nil {
+			return err
 		}
+		return w.Close()
+	}
 
+	if enc == nil {
+		var err error
+		enc, err = zstd.NewWriter(nil,
+			zstd.WithEncoderLevel(zstd.EncoderLevel(*level)),
+			zstd.WithEncoderCRC(*checksum))
+		noError(err)
+	}
+	if *contentSize && inSize >= 0 {
+		enc.ResetContentSize(out, inSize)
+	} else {
 		enc.Reset(out)
+	}
+	if _, err := io.Copy(enc, in); err != nil {
+		return err
+	}
+	return enc.Close()
+}
 
-		start := time.Now()
-		_, err = io.Copy(enc, in)
-		if err != nil {
-			panic(err)
+func decompress(in io.Reader, out io.Writer) error {
+	if *impl == "cgo" {
+		r := dzstd.NewReader(in)
+		if _, err := io.Copy(out, r); err != nil {
+			return err
 		}
-		duration = time.Now().Sub(start)
+		return r.Close()
+	}
+
+	if dec == nil {
+		var err error
+		dec, err = zstd.NewReader(nil)
+		noError(err)
+	}
+	if err := dec.Reset(in); err != nil {
+		return err
+	}
+	_, err := io.Copy(out, dec)
+	return err
+}
+
+func processFile(inName string) {
+	outName := getOutName(inName)
+	in, inSize := openIn(inName)
+	out := openOut(outName)
 
-		if err := enc.Close(); err != nil {
-			panic(err)
+	countedIn := &rcounter{in: in}
+	countedOut := &wcounter{out: out}
+	start := time.Now()
+	var err error
+	if *decompressMode {
+		err = decompress(countedIn, countedOut)
+	} else {
+		err = compress(countedIn, inSize, countedOut)
+	}
+	duration := time.Now().Sub(start)
+
+	if in != os.Stdin {
+		noError(in.Close())
+	}
+	if out != os.Stdout {
+		if closeErr := out.Close(); err == nil {
+			err = closeErr
 		}
-		if err := in.Close(); err != nil {
-			panic(err)
+		if err != nil {
+			// Partial output is removed, as zstd does
+			_ = os.Remove(outName)
 		}
-		if err := out.Close(); err != nil {
-			panic(err)
+	}
+	if err != nil {
+		log.Fatalf("%s: %s", inName, err)
+	}
+
+	rawSize, zstdSize := countedIn.n, countedOut.n
+	if *decompressMode {
+		rawSize, zstdSize = zstdSize, rawSize
+	}
+	speed := float64(rawSize) / (1 << 20) / duration.Seconds()
+	// Report goes to stderr, as stdout may be used for the data
+	fmt.Fprintf(os.Stderr, "%s -> %s size: %d zstd size: %d time: %s speed: %.0f MiB/s\n",
+		inName, outName, rawSize, zstdSize, duration, speed)
+}
+
+func main() {
+	flag.Parse()
+
+	if *impl != "klauspost" && *impl != "cgo" {
+		log.Fatalf("Unknown implementation: %s", *impl)
+	}
+	if *impl == "cgo" && *checksum && isFlagSet("checksum") {
+		log.Fatal("cgo implementation does not support -checksum")
+	}
+	if *impl == "cgo" {
+		// Invalid level fails before any output file is created
+		cgoLevel(zstd.EncoderLevel(*level))
+	}
+
+	var inputs []string
+	if *inFile != "" {
+		inputs = append(inputs, *inFile)
+	}
+	inputs = append(inputs, flag.Args()...)
+	if len(inputs) == 0 {
+		inputs = append(inputs, "-")
+	}
+
+	if *compareApis || *encodeAll {
+		for _, name := range inputs {
+			in, _ := openIn(name)
+			runCompareApis(in, zstd.EncoderLevel(*level))
 		}
+		return
 	}
 
-	speed := float64(inSize) / (1 << 20) / duration.Seconds()
-	fmt.Printf("File size: %d time: %s speed: %.0f MiB/s", inSize, duration, speed)
+	if len(inputs) > 1 && *outFile != "" && *outFile != "-" {
+		log.Fatal("-out can be used with multiple inputs only as '-' (stdout)")
+	}
+	for _, name := range inputs {
+		processFile(name)
+	}
 }
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Frame format: https://github.com/facebook/zstd/blob/dev/doc/zstd_compression_format.md#frames
+const (
+	frameMagic        = 0xFD2FB528
+	skippableMagic    = 0x184D2A50
+	skippableMagicMax = 0x184D2A5F
+)
+
+type BlockType int
+
+const (
+	BlockRaw = iota
+	BlockRLE
+	BlockCompressed
+	BlockReserved
+)
+
+func (t BlockType) String() string {
+	return [...]string{"raw", "rle", "compressed", "reserved"}[t]
+}
+
+type Block struct {
+	Offset int64 // offset of the block header in the input
+	Type   BlockType
+	Last   bool
+	// Size of the block content, for RLE blocks this is the regenerated size, and the content is a single byte
+	Size int
+}
+
+type Frame struct {
+	Offset int64
+	// Whole frame, including header, blocks and checksum
+	Data []byte
+
+	Skippable bool
+	Magic     uint32
+
+	HeaderSize    int
+	SingleSegment bool
+	WindowSize    uint64
+	// -1 if content size is not present in the header
+	ContentSize  int64
+	DictionaryID uint32
+	HasChecksum  bool
+	Checksum     uint32
+	Blocks       []Block
+}
+
+var errTruncated = errors.New("truncated input")
+
+// parseFrame parses a single frame at the beginning of in. Returned frame data is a subslice of in.
+func parseFrame(in []byte, offset int64) (*Frame, error) {
+	if len(in) < 4 {
+		return nil, errTruncated
+	}
+	f := &Frame{Offset: offset, Magic: binary.LittleEndian.Uint32(in), ContentSize: -1}
+
+	if f.Magic >= skippableMagic && f.Magic <= skippableMagicMax {
+		if len(in) < 8 {
+			return nil, errTruncated
+		}
+		f.Skippable = true
+		f.HeaderSize = 8
+		size := int64(binary.LittleEndian.Uint32(in[4:]))
+		if int64(len(in)) < 8+size {
+			return nil, errTruncated
+		}
+		f.ContentSize = size
+		f.Data = in[:8+size]
+		return f, nil
+	}
+	if f.Magic != frameMagic {
+		return nil, fmt.Errorf("unknown magic number 0x%08x", f.Magic)
+	}
+
+	pos := 4
+	if len(in) < pos+1 {
+		return nil, errTruncated
+	}
+	fhd := in[pos]
+	pos++
+	if fhd&0x08 != 0 {
+		return nil, errors.New("reserved bit set in frame header descriptor")
+	}
+	fcsFlag := fhd >> 6
+	f.SingleSegment = fhd&0x20 != 0
+	f.HasChecksum = fhd&0x04 != 0
+	dictIdFlag := fhd & 0x03
+
+	if !f.SingleSegment {
+		if len(in) < pos+1 {
+			return nil, errTruncated
+		}
+		wd := in[pos]
+		pos++
+		windowLog := 10 + uint(wd>>3)
+		windowBase := uint64(1) << windowLog
+		f.WindowSize = windowBase + (windowBase/8)*uint64(wd&0x07)
+	}
+
+	dictIdSize := [...]int{0, 1, 2, 4}[dictIdFlag]
+	if len(in) < pos+dictIdSize {
+		return nil, errTruncated
+	}
+	switch dictIdSize {
+	case 1:
+		f.DictionaryID = uint32(in[pos])
+	case 2:
+		f.DictionaryID = uint32(binary.LittleEndian.Uint16(in[pos:]))
+	case 4:
+		f.DictionaryID = binary.LittleEndian.Uint32(in[pos:])
+	}
+	pos += dictIdSize
+
+	fcsSize := [...]int{0, 2, 4, 8}[fcsFlag]
+	if fcsFlag == 0 && f.SingleSegment {
+		fcsSize = 1
+	}
+	if len(in) < pos+fcsSize {
+		return nil, errTruncated
+	}
+	switch fcsSize {
+	case 1:
+		f.ContentSize = int64(in[pos])
+	case 2:
+		f.ContentSize = int64(binary.LittleEndian.Uint16(in[pos:])) + 256
+	case 4:
+		f.ContentSize = int64(binary.LittleEndian.Uint32(in[pos:]))
+	case 8:
+		f.ContentSize = int64(binary.LittleEndian.Uint64(in[pos:]))
+	}
+	pos += fcsSize
+	if f.SingleSegment {
+		f.WindowSize = uint64(f.ContentSize)
+	}
+	f.HeaderSize = pos
+
+	for {
+		if len(in) < pos+3 {
+			return nil, errTruncated
+		}
+		bh := uint32(in[pos]) | uint32(in[pos+1])<<8 | uint32(in[pos+2])<<16
+		b := Block{
+			Offset: offset + int64(pos),
+			Last:   bh&1 != 0,
+			Type:   BlockType((bh >> 1) & 0x03),
+			Size:   int(bh >> 3),
+		}
+		pos += 3
+		f.Blocks = append(f.Blocks, b)
+
+		switch b.Type {
+		case BlockRaw, BlockCompressed:
+			pos += b.Size
+		case BlockRLE:
+			pos++
+		default:
+			return nil, fmt.Errorf("reserved block type at offset %d", b.Offset)
+		}
+		if len(in) < pos {
+			return nil, errTruncated
+		}
+		if b.Last {
+			break
+		}
+	}
+
+	if f.HasChecksum {
+		if len(in) < pos+4 {
+			return nil, errTruncated
+		}
+		f.Checksum = binary.LittleEndian.Uint32(in[pos:])
+		pos += 4
+	}
+	f.Data = in[:pos]
+	return f, nil
+}
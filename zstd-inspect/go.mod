@@ -0,0 +1,5 @@
+module zstd-inspect
+
+go 1.17
+
+require github.com/klauspost/compress v1.13.6
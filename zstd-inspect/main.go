@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"github.com/klauspost/compress/zstd"
+	"io/ioutil"
+	"log"
+	"os"
+)
+import "flag"
+
+var listBlocks = flag.Bool("blocks", false, "List every block of each frame")
+var verify = flag.Bool("verify", true, "Decode every frame to validate content checksum and content size")
+
+var decoder *zstd.Decoder
+
+func verifyFrame(f *Frame) (int, error) {
+	if decoder == nil {
+		var err error
+		decoder, err = zstd.NewReader(nil, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			panic(err)
+		}
+	}
+	// DecodeAll validates the checksum if the frame has one
+	out, err := decoder.DecodeAll(f.Data, nil)
+	if err != nil {
+		return len(out), err
+	}
+	if f.ContentSize >= 0 && int64(len(out)) != f.ContentSize {
+		return len(out), fmt.Errorf("decoded size %d != content size %d", len(out), f.ContentSize)
+	}
+	return len(out), nil
+}
+
+func printFrame(idx int, f *Frame) (ok bool) {
+	if f.Skippable {
+		fmt.Printf("frame %d @%d: skippable, magic: 0x%08x, size: %d\n", idx, f.Offset, f.Magic, f.ContentSize)
+		return true
+	}
+
+	contentSize := "unknown"
+	if f.ContentSize >= 0 {
+		contentSize = fmt.Sprint(f.ContentSize)
+	}
+	checksum := "none"
+	if f.HasChecksum {
+		checksum = fmt.Sprintf("%08x", f.Checksum)
+	}
+	fmt.Printf("frame %d @%d: zstd, size: %d, header size: %d\n", idx, f.Offset, len(f.Data), f.HeaderSize)
+	fmt.Printf("  window size: %d, single segment: %t, content size: %s, checksum: %s, dictionary ID: %d\n",
+		f.WindowSize, f.SingleSegment, contentSize, checksum, f.DictionaryID)
+
+	var counts [4]int
+	for _, b := range f.Blocks {
+		counts[b.Type]++
+	}
+	fmt.Printf("  blocks: %d (%s: %d, %s: %d, %s: %d)\n", len(f.Blocks),
+		BlockType(BlockCompressed), counts[BlockCompressed],
+		BlockType(BlockRaw), counts[BlockRaw],
+		BlockType(BlockRLE), counts[BlockRLE])
+	if *listBlocks {
+		for i, b := range f.Blocks {
+			fmt.Printf("    block %d @%d: %s, size: %d, last: %t\n", i, b.Offset, b.Type, b.Size, b.Last)
+		}
+	}
+
+	if !*verify {
+		return true
+	}
+	if f.DictionaryID != 0 {
+		fmt.Printf("  verify: skipped, dictionary not available\n")
+		return true
+	}
+	if n, err := verifyFrame(f); err != nil {
+		fmt.Printf("  verify: FAILED after %d bytes: %s\n", n, err)
+		return false
+	} else {
+		fmt.Printf("  verify: OK, decoded size: %d\n", n)
+		return true
+	}
+}
+
+func inspect(name string) (ok bool) {
+	var data []byte
+	var err error
+	if name == "-" {
+		data, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		data, err = ioutil.ReadFile(name)
+	}
+	if err != nil {
+		log.Printf("%s: %s", name, err)
+		return false
+	}
+
+	fmt.Printf("%s: size: %d\n", name, len(data))
+	ok = true
+	var offset int64
+	for idx := 0; offset < int64(len(data)); idx++ {
+		f, err := parseFrame(data[offset:], offset)
+		if err != nil {
+			fmt.Printf("frame %d @%d: invalid: %s\n", idx, offset, err)
+			return false
+		}
+		if !printFrame(idx, f) {
+			ok = false
+		}
+		offset += int64(len(f.Data))
+	}
+	return ok
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] file... ('-' for stdin)\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	files := flag.Args()
+	if len(files) == 0 {
+		files = []string{"-"}
+	}
+
+	failed := false
+	for _, name := range files {
+		if !inspect(name) {
+			failed = true
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}